@@ -10,6 +10,10 @@ import (
 const (
 	EventTypeCount  = 0
 	EventTypeTiming = 1
+	EventTypeGauge  = 2
+	EventTypeSet    = 3
+	// Number of event types (size of the aggregate slice per name)
+	eventTypes = 4
 	seconds = 1e9
 )
 
@@ -17,10 +21,33 @@ type Event struct {
 	Type  int8
 	Name  string
 	Value int64
+	// Gauge value is a delta to the last value instead of an absolute value
+	Delta bool
+	// Member of a set event
+	Member string
+	// Fraction of events that were sent by the client (0 or 1 if not sampled)
+	SampleRate float64
+	// Dimensions of the event, events are aggregated by name and tags
+	Tags map[string]string
+	// Time of the event as Unix timestamp in seconds (0 for the time of arrival)
+	Time int64
 }
 
+// Get the number of events this event represents, scaled by the sample rate
+func (event *Event) weight() float64 {
+	if event.SampleRate <= 0 || event.SampleRate >= 1 {
+		return 1
+	}
+	return 1 / event.SampleRate
+}
+
+// Number of unique members of a set before switching to an approximate count
+var SetSketchThreshold = 1000
+
 type Count struct {
 	Value int64
+	// Fraction of a scaled value that is carried to the next event
+	remainder float64
 }
 
 type Timing struct {
@@ -28,52 +55,215 @@ type Timing struct {
 	Count int64
 	Min   int64
 	Max   int64
+	// Sum of squared values for variance
+	SumSquares float64
+	// Distribution of values for percentiles
+	Histogram Histogram
+	// Fraction of a scaled count that is carried to the next event
+	remainder float64
+}
+
+type Gauge struct {
+	Value int64
+	// Only deltas were reduced, so the value is a change to the last value
+	Delta bool
+	// Time of the last absolute value as Unix timestamp in seconds
+	Time int64
+}
+
+type Set struct {
+	// Number of unique members, estimated if the set exceeded SetSketchThreshold
+	Cardinality int64
+	members     map[string]bool
+	sketch      *hyperLogLog
 }
 
 type Aggregate interface {
 	reduce(event *Event)
 }
 
+// Scale a value by the weight of an event, the fractional part is carried over
+// to the next call to keep the sum of scaled values accurate
+func scale(value float64, weight float64, remainder *float64) int64 {
+	scaled := value*weight + *remainder
+	n := math.Floor(scaled + 0.5)
+	*remainder = scaled - n
+	return int64(n)
+}
+
 func (count *Count) reduce(event *Event) {
-	count.Value += event.Value
+	count.Value += scale(float64(event.Value), event.weight(), &count.remainder)
 }
 
 func (timing *Timing) reduce(event *Event) {
-	timing.Count++
-	timing.Sum += event.Value
+	// Number of values this event represents
+	n := scale(1, event.weight(), &timing.remainder)
+	timing.Count += n
+	timing.Sum += event.Value * n
+	timing.SumSquares += float64(event.Value) * float64(event.Value) * float64(n)
 	if timing.Min > event.Value {
 		timing.Min = event.Value
 	}
 	if timing.Max < event.Value {
 		timing.Max = event.Value
 	}
+	timing.Histogram.add(event.Value, n)
+}
+
+func (gauge *Gauge) reduce(event *Event) {
+	if event.Delta {
+		gauge.Value += event.Value
+		return
+	}
+	gauge.Value = event.Value
+	gauge.Delta = false
+	gauge.Time = event.Time
+	if gauge.Time == 0 {
+		gauge.Time = time.Seconds()
+	}
+}
+
+// Merge a gauge of the same interval, deltas are added and an absolute value replaces the value
+// only if it is not older
+func (gauge *Gauge) merge(other *Gauge) {
+	if other.Delta {
+		gauge.Value += other.Value
+	} else if other.Time >= gauge.Time {
+		*gauge = *other
+	}
+}
+
+func (set *Set) reduce(event *Event) {
+	if set.sketch != nil {
+		set.sketch.add(event.Member)
+		return
+	}
+	set.members[event.Member] = true
+	if len(set.members) > SetSketchThreshold {
+		// Bound memory by switching to a sketch
+		set.sketch = newHyperLogLog()
+		for member := range set.members {
+			set.sketch.add(member)
+		}
+		set.members = nil
+	}
+}
+
+// Get the cardinality from the members or sketch
+// Sets restored without members (see SpoolBackend) keep their cardinality
+func (set *Set) cardinality() int64 {
+	if set.sketch != nil {
+		return set.sketch.estimate()
+	} else if set.members != nil {
+		return int64(len(set.members))
+	}
+	return set.Cardinality
+}
+
+// Merge the members or sketch of another set of the same interval
+// Sets restored without members cannot be merged, the larger cardinality is kept then
+func (set *Set) merge(other *Set) {
+	if set.members == nil && set.sketch == nil || other.members == nil && other.sketch == nil {
+		set.Cardinality = int64(math.Fmax(float64(set.cardinality()), float64(other.cardinality())))
+		set.members, set.sketch = nil, nil
+		return
+	}
+	if other.sketch != nil {
+		sketch := newHyperLogLog()
+		sketch.merge(other.sketch)
+		for member := range set.members {
+			sketch.add(member)
+		}
+		if set.sketch != nil {
+			sketch.merge(set.sketch)
+		}
+		set.members, set.sketch = nil, sketch
+		return
+	}
+	for member := range other.members {
+		set.reduce(&Event{Member: member})
+	}
+}
+
+// Add the values of another timing to this timing
+func (timing *Timing) merge(other *Timing) {
+	if other.Count == 0 {
+		return
+	}
+	if timing.Count == 0 || other.Min < timing.Min {
+		timing.Min = other.Min
+	}
+	if timing.Count == 0 || other.Max > timing.Max {
+		timing.Max = other.Max
+	}
+	timing.Sum += other.Sum
+	timing.Count += other.Count
+	timing.SumSquares += other.SumSquares
+	if timing.Histogram == nil {
+		timing.Histogram = make(Histogram)
+	}
+	timing.Histogram.merge(other.Histogram)
 }
 
 func (timing *Timing) Avg() float64 {
 	return float64(timing.Sum) / float64(timing.Count)
 }
 
+// Get the population variance of the values
+func (timing *Timing) Variance() float64 {
+	avg := timing.Avg()
+	// Rounding errors could result in a slightly negative variance
+	return math.Fmax(timing.SumSquares/float64(timing.Count)-avg*avg, 0)
+}
+
+func (timing *Timing) StdDev() float64 {
+	return math.Sqrt(timing.Variance())
+}
+
+// Get the approximate value at percentile p (between 0 and 100)
+func (timing *Timing) Percentile(p float64) float64 {
+	value := timing.Histogram.Quantile(p / 100)
+	// Bucket values are approximated, keep them inside the exact bounds
+	return math.Fmin(math.Fmax(value, float64(timing.Min)), float64(timing.Max))
+}
+
+// Aggregates by series key (see SeriesKey)
 type AggregateMap map[string][]Aggregate
 
 func (m AggregateMap) AddEvent(event *Event) {
-	if m[event.Name] == nil {
-		m[event.Name] = make([]Aggregate, 2)
+	key := SeriesKey(event.Name, event.Tags)
+	if m[key] == nil {
+		m[key] = make([]Aggregate, eventTypes)
 	}
 	switch event.Type {
 	case EventTypeCount:
-		count := m[event.Name][EventTypeCount]
+		count := m[key][EventTypeCount]
 		if count == nil {
 			count = &Count{}
-			m[event.Name][EventTypeCount] = count
+			m[key][EventTypeCount] = count
 		}
 		count.reduce(event)
 	case EventTypeTiming:
-		timing := m[event.Name][EventTypeTiming]
+		timing := m[key][EventTypeTiming]
 		if timing == nil {
-			timing = &Timing{0, 0, math.MaxInt64, 0}
-			m[event.Name][EventTypeTiming] = timing
+			timing = &Timing{Min: math.MaxInt64, Histogram: make(Histogram)}
+			m[key][EventTypeTiming] = timing
 		}
 		timing.reduce(event)
+	case EventTypeGauge:
+		gauge := m[key][EventTypeGauge]
+		if gauge == nil {
+			gauge = &Gauge{Delta: true}
+			m[key][EventTypeGauge] = gauge
+		}
+		gauge.reduce(event)
+	case EventTypeSet:
+		set := m[key][EventTypeSet]
+		if set == nil {
+			set = &Set{members: make(map[string]bool)}
+			m[key][EventTypeSet] = set
+		}
+		set.reduce(event)
 	}
 }
 
@@ -99,34 +289,218 @@ func (m AggregateMap) Timings() map[string]*Timing {
 	return timings
 }
 
-// Stores events sent to the channel
-// Every interval seconds the events will be aggregated and stored in the backend
-func Aggregator(eventChan chan Event, backend Backend, interval int) {
-	events := make([]Event, 0, 64)
-	timer := time.Tick(int64(interval) * seconds)
+func (m AggregateMap) Gauges() map[string]*Gauge {
+	gauges := make(map[string]*Gauge, len(m))
+	for name, arr := range m {
+		if arr[EventTypeGauge] != nil {
+			gauge, _ := arr[EventTypeGauge].(*Gauge)
+			gauges[name] = gauge
+		}
+	}
+	return gauges
+}
+
+func (m AggregateMap) Sets() map[string]*Set {
+	sets := make(map[string]*Set, len(m))
+	for name, arr := range m {
+		if arr[EventTypeSet] != nil {
+			// Copy the set, so the aggregates can be read concurrently
+			set, _ := arr[EventTypeSet].(*Set)
+			sets[name] = &Set{Cardinality: set.cardinality()}
+		}
+	}
+	return sets
+}
+
+// Get the sums of the counts, gauges or set cardinalities of all series by name and by name and tag,
+// keyed like "name" and "name;key=value". Backends store one total per interval, so totals and tag
+// filters are the sum of the matching series instead of their average
+func (m AggregateMap) Totals(eventType int) map[string]float64 {
+	totals := make(map[string]float64)
+	for key, arr := range m {
+		var value float64
+		switch aggregate := arr[eventType].(type) {
+		case *Count:
+			value = float64(aggregate.Value)
+		case *Gauge:
+			value = float64(aggregate.Value)
+		case *Set:
+			value = float64(aggregate.cardinality())
+		default:
+			continue
+		}
+		name, tags := ParseSeriesKey(key)
+		totals[name] += value
+		for tagKey, tagValue := range tags {
+			totals[SeriesKey(name, map[string]string{tagKey: tagValue})] += value
+		}
+	}
+	return totals
+}
+
+// Merge the aggregates of another aggregation of the same interval into this map
+// Counts and timings are added up, gauge deltas are added and newer gauge values replace older ones. Sets are
+// merged by their members or sketches, or keep the larger cardinality if they were stored without members.
+// The other map must not be changed afterwards
+func (m AggregateMap) Merge(other AggregateMap) {
+	for key, arr := range other {
+		if m[key] == nil {
+			m[key] = make([]Aggregate, eventTypes)
+		}
+		for i, aggregate := range arr {
+			if aggregate == nil {
+				continue
+			}
+			if m[key][i] == nil {
+				m[key][i] = aggregate
+				continue
+			}
+			switch existing := m[key][i].(type) {
+			case *Count:
+				existing.Value += aggregate.(*Count).Value
+			case *Timing:
+				existing.merge(aggregate.(*Timing))
+			case *Gauge:
+				existing.merge(aggregate.(*Gauge))
+			case *Set:
+				existing.merge(aggregate.(*Set))
+			}
+		}
+	}
+}
+
+// Restore an aggregate map from the aggregates by series key, as stored by a backend
+func restoreAggregates(counts map[string]*Count, timings map[string]*Timing, gauges map[string]*Gauge, sets map[string]*Set) AggregateMap {
+	m := make(AggregateMap)
+	get := func(key string) []Aggregate {
+		if m[key] == nil {
+			m[key] = make([]Aggregate, eventTypes)
+		}
+		return m[key]
+	}
+	for key, count := range counts {
+		get(key)[EventTypeCount] = count
+	}
+	for key, timing := range timings {
+		get(key)[EventTypeTiming] = timing
+	}
+	for key, gauge := range gauges {
+		get(key)[EventTypeGauge] = gauge
+	}
+	for key, set := range sets {
+		get(key)[EventTypeSet] = set
+	}
+	return m
+}
+
+// Create an empty map for the next interval that keeps the last value of all gauges
+// Gauges are reported in every interval until they are updated, deltas apply to the last value
+func (m AggregateMap) Next() AggregateMap {
+	next := make(AggregateMap)
+	for name, gauge := range m.Gauges() {
+		next[name] = make([]Aggregate, eventTypes)
+		next[name][EventTypeGauge] = &Gauge{Value: gauge.Value, Time: gauge.Time}
+	}
+	return next
+}
+
+// Reduces events and returns the aggregates of an interval on flush
+type reducer interface {
+	AddEvent(event *Event)
+	Flush() AggregateMap
+}
+
+// A reducer with a single map
+type singleMap struct {
+	m AggregateMap
+}
+
+func (s *singleMap) AddEvent(event *Event) {
+	s.m.AddEvent(event)
+}
+
+func (s *singleMap) Flush() AggregateMap {
+	m := s.m
+	s.m = m.Next()
+	return m
+}
+
+// Reduces events sent to the channel as they arrive
+// At the end of every interval the aggregates will be stored in the backend with the start of the
+// interval and a new map is started, so memory is bounded by the number of series instead of the
+// number of events. Intervals are aligned to the wall clock (see AlignedTick)
+// Events with a time before the last flush are merged into the interval they belong to
+// When a channel is sent to quit, the remaining events are stored and true is sent to that channel
+// Aggregations are stored in order from the aggregator, so the backend should queue them (see RetryBackend)
+func Aggregator(eventChan chan Event, backend Backend, interval int, quit chan chan bool) {
+	aggregate(&singleMap{make(AggregateMap)}, eventChan, backend, interval, quit)
+}
+
+func aggregate(r reducer, eventChan chan Event, backend Backend, interval int, quit chan chan bool) {
+	events := 0
+	late := newLateEvents(IntervalStart(time.Seconds(), interval))
+	add := func(event *Event) {
+		if late.isLate(event) {
+			late.add(event, time.Seconds())
+		} else {
+			r.AddEvent(event)
+			events++
+		}
+	}
+	timer := AlignedTick(interval)
 	for {
 		select {
 		case event := <-eventChan:
-			events = append(events, event)
-		case _ = <-timer:
-			log.Printf("Aggregating %d events", len(events))
-			m := make(AggregateMap)
-			for _, event := range events {
-				m.AddEvent(&event)
-			}
-			go func() {
-				if err := backend.Store(m, time.LocalTime()); err != nil {
-					log.Printf("Error storing aggregation: %s", err)
+			add(&event)
+		case end := <-timer:
+			log.Printf("Aggregated %d events", events)
+			// The flushed map is not touched by the reducer anymore
+			storeAggregates(backend, r.Flush(), end-int64(interval))
+			events = 0
+			late.flush(backend, end)
+		case done := <-quit:
+			// Reduce events that were sent before quitting
+			for drained := false; !drained; {
+				select {
+				case event := <-eventChan:
+					add(&event)
+				default:
+					drained = true
 				}
-			}()
-			// Print values for debugging
-			for name, count := range m.Counts() {
-				log.Printf("Count: %s=%d\n", name, count.Value)
 			}
-			for name, timing := range m.Timings() {
-				log.Printf("Timer: %s=%f (Min: %d, Max: %d)\n", name, timing.Avg(), timing.Min, timing.Max)
-			}
-			events = events[0:0]
+			now := time.Seconds()
+			log.Printf("Aggregated %d events before quitting", events)
+			storeAggregates(backend, r.Flush(), IntervalStart(now, interval))
+			late.flush(backend, now)
+			done <- true
+			return
 		}
 	}
 }
+
+// Store the aggregates of the interval starting at start, the map must not be changed afterwards
+func storeAggregates(backend Backend, m AggregateMap, start int64) {
+	logAggregates(m)
+	if err := backend.Store(m, time.SecondsToLocalTime(start)); err != nil {
+		log.Printf("Error storing aggregation: %s", err)
+	}
+}
+
+// Print values for debugging
+func logAggregates(m AggregateMap) {
+	for name, count := range m.Counts() {
+		log.Printf("Count: %s=%d\n", name, count.Value)
+	}
+	for name, timing := range m.Timings() {
+		log.Printf("Timer: %s=%f (Min: %d, Max: %d, StdDev: %f)\n", name, timing.Avg(), timing.Min, timing.Max, timing.StdDev())
+		for _, p := range Percentiles {
+			log.Printf("Timer: %s %s=%f\n", name, PercentileLabel(p), timing.Percentile(p))
+		}
+	}
+	for name, gauge := range m.Gauges() {
+		log.Printf("Gauge: %s=%d\n", name, gauge.Value)
+	}
+	for name, set := range m.Sets() {
+		log.Printf("Set: %s=%d\n", name, set.Cardinality)
+	}
+}
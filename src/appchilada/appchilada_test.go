@@ -2,19 +2,31 @@ package appchilada_test
 
 import (
 	"appchilada"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
 	"testing"
+	"time"
 )
 
 var countEvents = []appchilada.Event{
-	{appchilada.EventTypeCount, "test.foo", 2},
-	{appchilada.EventTypeCount, "test.foo", 3},
-	{appchilada.EventTypeCount, "test.bar", 1},
+	{Type: appchilada.EventTypeCount, Name: "test.foo", Value: 2},
+	{Type: appchilada.EventTypeCount, Name: "test.foo", Value: 3},
+	{Type: appchilada.EventTypeCount, Name: "test.bar", Value: 1},
 }
 
 var timingEvents = []appchilada.Event{
-	{appchilada.EventTypeTiming, "test.foo", 334.0},
-	{appchilada.EventTypeTiming, "test.bar", 656.0},
-	{appchilada.EventTypeTiming, "test.bar", 2434.0},
+	{Type: appchilada.EventTypeTiming, Name: "test.foo", Value: 334.0},
+	{Type: appchilada.EventTypeTiming, Name: "test.bar", Value: 656.0},
+	{Type: appchilada.EventTypeTiming, Name: "test.bar", Value: 2434.0},
+}
+
+var gaugeEvents = []appchilada.Event{
+	{Type: appchilada.EventTypeGauge, Name: "test.foo", Value: 10},
+	{Type: appchilada.EventTypeGauge, Name: "test.foo", Value: 4},
+	{Type: appchilada.EventTypeGauge, Name: "test.bar", Value: 7},
+	{Type: appchilada.EventTypeGauge, Name: "test.bar", Value: -2, Delta: true},
 }
 
 func TestAggregateMapAddCounts(t *testing.T) {
@@ -48,4 +60,618 @@ func TestAggregateMapAddTimings(t *testing.T) {
 	if timing.Sum != 3090 {
 		t.Errorf("Expected timing with sum %d for 'test.bar', got %d", 3090, timing.Sum)
 	}
+	// Values 656 and 2434 deviate by 889 from the average
+	if timing.Variance() != 889*889 {
+		t.Errorf("Expected timing with variance %d for 'test.bar', got %f", 889*889, timing.Variance())
+	}
+	if timing.StdDev() != 889 {
+		t.Errorf("Expected timing with stddev %d for 'test.bar', got %f", 889, timing.StdDev())
+	}
+}
+
+func TestAggregateMapAddGauges(t *testing.T) {
+	m := make(appchilada.AggregateMap)
+	for _, e := range gaugeEvents {
+		m.AddEvent(&e)
+	}
+	gauges := m.Gauges()
+	if len(gauges) != 2 {
+		t.Errorf("Expected gauges to be of length %d, got %d", 2, len(gauges))
+	}
+	if gauge := gauges["test.foo"]; gauge == nil || gauge.Value != 4 {
+		t.Errorf("Expected gauge with value %d for 'test.foo', got %v", 4, gauge)
+	}
+	if gauge := gauges["test.bar"]; gauge == nil || gauge.Value != 5 {
+		t.Errorf("Expected gauge with value %d for 'test.bar', got %v", 5, gauge)
+	}
+}
+
+func TestAggregateMapNextKeepsGauges(t *testing.T) {
+	m := make(appchilada.AggregateMap)
+	for _, e := range gaugeEvents {
+		m.AddEvent(&e)
+	}
+	next := m.Next()
+	next.AddEvent(&appchilada.Event{Type: appchilada.EventTypeGauge, Name: "test.bar", Value: 3, Delta: true})
+	gauges := next.Gauges()
+	if gauge := gauges["test.foo"]; gauge == nil || gauge.Value != 4 {
+		t.Errorf("Expected gauge with value %d for 'test.foo', got %v", 4, gauge)
+	}
+	if gauge := gauges["test.bar"]; gauge == nil || gauge.Value != 8 {
+		t.Errorf("Expected gauge with value %d for 'test.bar', got %v", 8, gauge)
+	}
+	if len(next.Counts()) != 0 {
+		t.Errorf("Expected no counts in next map, got %d", len(next.Counts()))
+	}
+}
+
+func TestAggregateMapAddSets(t *testing.T) {
+	m := make(appchilada.AggregateMap)
+	for _, member := range []string{"a", "b", "a", "c", "b"} {
+		m.AddEvent(&appchilada.Event{Type: appchilada.EventTypeSet, Name: "test.users", Member: member})
+	}
+	set := m.Sets()["test.users"]
+	if set == nil || set.Cardinality != 3 {
+		t.Errorf("Expected set with cardinality %d for 'test.users', got %v", 3, set)
+	}
+}
+
+func TestAggregateMapAddSetsApproximate(t *testing.T) {
+	defer func(threshold int) { appchilada.SetSketchThreshold = threshold }(appchilada.SetSketchThreshold)
+	appchilada.SetSketchThreshold = 100
+	m := make(appchilada.AggregateMap)
+	for i := 0; i < 20000; i++ {
+		member := strconv.Itoa(i % 10000)
+		m.AddEvent(&appchilada.Event{Type: appchilada.EventTypeSet, Name: "test.users", Member: member})
+	}
+	set := m.Sets()["test.users"]
+	if set == nil || set.Cardinality < 9500 || set.Cardinality > 10500 {
+		t.Errorf("Expected set with cardinality of about %d for 'test.users', got %v", 10000, set)
+	}
+}
+
+func TestTimingPercentiles(t *testing.T) {
+	m := make(appchilada.AggregateMap)
+	for i := int64(1); i <= 1000; i++ {
+		m.AddEvent(&appchilada.Event{Type: appchilada.EventTypeTiming, Name: "test.foo", Value: i})
+	}
+	timing := m.Timings()["test.foo"]
+	for _, p := range []float64{50, 90, 99} {
+		expected := p * 10
+		if value := timing.Percentile(p); value < expected*0.98 || value > expected*1.02 {
+			t.Errorf("Expected %s of about %f for 'test.foo', got %f", appchilada.PercentileLabel(p), expected, value)
+		}
+	}
+	if value := timing.Percentile(100); value != 1000 {
+		t.Errorf("Expected p100 to be the max %d for 'test.foo', got %f", 1000, value)
+	}
+}
+
+func TestAggregateMapAddSampledEvents(t *testing.T) {
+	m := make(appchilada.AggregateMap)
+	for i := 0; i < 3; i++ {
+		m.AddEvent(&appchilada.Event{Type: appchilada.EventTypeCount, Name: "test.foo", Value: 1, SampleRate: 0.3})
+		m.AddEvent(&appchilada.Event{Type: appchilada.EventTypeTiming, Name: "test.foo", Value: 100, SampleRate: 0.3})
+	}
+	if count := m.Counts()["test.foo"]; count == nil || count.Value != 10 {
+		t.Errorf("Expected count with value %d for 'test.foo', got %v", 10, count)
+	}
+	timing := m.Timings()["test.foo"]
+	if timing == nil || timing.Count != 10 {
+		t.Errorf("Expected timing with count %d for 'test.foo', got %v", 10, timing)
+	}
+	if timing.Avg() != 100 {
+		t.Errorf("Expected timing with avg %d for 'test.foo', got %f", 100, timing.Avg())
+	}
+}
+
+func TestSeriesKey(t *testing.T) {
+	key := appchilada.SeriesKey("api.login", map[string]string{"region": "us-east", "host": "a;b"})
+	if key != "api.login;host=a_b;region=us-east" {
+		t.Errorf("Expected series key %q, got %q", "api.login;host=a_b;region=us-east", key)
+	}
+	name, tags := appchilada.ParseSeriesKey(key)
+	if name != "api.login" || len(tags) != 2 || tags["region"] != "us-east" || tags["host"] != "a_b" {
+		t.Errorf("Expected name and tags from series key %q, got %q and %v", key, name, tags)
+	}
+}
+
+func TestAggregateMapAddTaggedEvents(t *testing.T) {
+	m := make(appchilada.AggregateMap)
+	m.AddEvent(&appchilada.Event{Type: appchilada.EventTypeCount, Name: "test.foo", Value: 1, Tags: map[string]string{"region": "eu"}})
+	m.AddEvent(&appchilada.Event{Type: appchilada.EventTypeCount, Name: "test.foo", Value: 2, Tags: map[string]string{"region": "us"}})
+	m.AddEvent(&appchilada.Event{Type: appchilada.EventTypeCount, Name: "test.foo", Value: 3, Tags: map[string]string{"region": "eu"}})
+	counts := m.Counts()
+	if len(counts) != 2 {
+		t.Errorf("Expected counts to be of length %d, got %d", 2, len(counts))
+	}
+	if count := counts["test.foo;region=eu"]; count == nil || count.Value != 4 {
+		t.Errorf("Expected count with value %d for 'test.foo;region=eu', got %v", 4, count)
+	}
+}
+
+func TestAggregateMapTotals(t *testing.T) {
+	m := make(appchilada.AggregateMap)
+	m.AddEvent(&appchilada.Event{Type: appchilada.EventTypeCount, Name: "test.foo", Value: 4, Tags: map[string]string{"region": "eu", "host": "a"}})
+	m.AddEvent(&appchilada.Event{Type: appchilada.EventTypeCount, Name: "test.foo", Value: 2, Tags: map[string]string{"region": "us", "host": "a"}})
+	m.AddEvent(&appchilada.Event{Type: appchilada.EventTypeGauge, Name: "test.foo", Value: 7})
+	totals := m.Totals(appchilada.EventTypeCount)
+	expected := map[string]float64{"test.foo": 6, "test.foo;region=eu": 4, "test.foo;region=us": 2, "test.foo;host=a": 6}
+	if len(totals) != len(expected) {
+		t.Errorf("Expected totals %v, got %v", expected, totals)
+	}
+	for key, value := range expected {
+		if totals[key] != value {
+			t.Errorf("Expected total %f for %q, got %f", value, key, totals[key])
+		}
+	}
+	if gauges := m.Totals(appchilada.EventTypeGauge); len(gauges) != 1 || gauges["test.foo"] != 7 {
+		t.Errorf("Expected gauge total %d for 'test.foo', got %v", 7, gauges)
+	}
+}
+
+func TestAggregateMapMerge(t *testing.T) {
+	m := make(appchilada.AggregateMap)
+	m.AddEvent(&appchilada.Event{Type: appchilada.EventTypeCount, Name: "test.foo", Value: 9})
+	m.AddEvent(&appchilada.Event{Type: appchilada.EventTypeTiming, Name: "test.foo", Value: 100})
+	m.AddEvent(&appchilada.Event{Type: appchilada.EventTypeGauge, Name: "test.foo", Value: 3})
+	late := make(appchilada.AggregateMap)
+	late.AddEvent(&appchilada.Event{Type: appchilada.EventTypeCount, Name: "test.foo", Value: 1})
+	late.AddEvent(&appchilada.Event{Type: appchilada.EventTypeTiming, Name: "test.foo", Value: 50})
+	late.AddEvent(&appchilada.Event{Type: appchilada.EventTypeGauge, Name: "test.foo", Value: 5})
+	late.AddEvent(&appchilada.Event{Type: appchilada.EventTypeCount, Name: "test.bar", Value: 2})
+	m.Merge(late)
+	if count := m.Counts()["test.foo"]; count == nil || count.Value != 10 {
+		t.Errorf("Expected count with value %d for 'test.foo', got %v", 10, count)
+	}
+	if count := m.Counts()["test.bar"]; count == nil || count.Value != 2 {
+		t.Errorf("Expected count with value %d for 'test.bar', got %v", 2, count)
+	}
+	if timing := m.Timings()["test.foo"]; timing == nil || timing.Count != 2 || timing.Sum != 150 || timing.Min != 50 || timing.Max != 100 {
+		t.Errorf("Expected merged timing for 'test.foo', got %v", timing)
+	}
+	if gauge := m.Gauges()["test.foo"]; gauge == nil || gauge.Value != 5 {
+		t.Errorf("Expected gauge with value %d for 'test.foo', got %v", 5, gauge)
+	}
+}
+
+func TestAggregateMapMergeLateGauges(t *testing.T) {
+	m := make(appchilada.AggregateMap)
+	m.AddEvent(&appchilada.Event{Type: appchilada.EventTypeGauge, Name: "test.foo", Value: 10, Time: 1323017545})
+	m.AddEvent(&appchilada.Event{Type: appchilada.EventTypeGauge, Name: "test.bar", Value: 10, Time: 1323017545})
+	late := make(appchilada.AggregateMap)
+	// A late delta changes the stored value, a late older value does not replace it
+	late.AddEvent(&appchilada.Event{Type: appchilada.EventTypeGauge, Name: "test.foo", Value: 3, Delta: true, Time: 1323017541})
+	late.AddEvent(&appchilada.Event{Type: appchilada.EventTypeGauge, Name: "test.bar", Value: 4, Time: 1323017541})
+	m.Merge(late)
+	if gauge := m.Gauges()["test.foo"]; gauge == nil || gauge.Value != 13 || gauge.Delta {
+		t.Errorf("Expected gauge with value %d for 'test.foo', got %v", 13, gauge)
+	}
+	if gauge := m.Gauges()["test.bar"]; gauge == nil || gauge.Value != 10 {
+		t.Errorf("Expected gauge with value %d for 'test.bar', got %v", 10, gauge)
+	}
+	newer := make(appchilada.AggregateMap)
+	newer.AddEvent(&appchilada.Event{Type: appchilada.EventTypeGauge, Name: "test.bar", Value: 7, Time: 1323017548})
+	m.Merge(newer)
+	if gauge := m.Gauges()["test.bar"]; gauge == nil || gauge.Value != 7 {
+		t.Errorf("Expected gauge with value %d for 'test.bar', got %v", 7, gauge)
+	}
+}
+
+func TestAggregateMapMergeSets(t *testing.T) {
+	defer func(threshold int) { appchilada.SetSketchThreshold = threshold }(appchilada.SetSketchThreshold)
+	appchilada.SetSketchThreshold = 100
+	addSet := func(m appchilada.AggregateMap, name string, from int, to int) {
+		for i := from; i < to; i++ {
+			m.AddEvent(&appchilada.Event{Type: appchilada.EventTypeSet, Name: name, Member: strconv.Itoa(i)})
+		}
+	}
+	m := make(appchilada.AggregateMap)
+	addSet(m, "test.small", 0, 20)
+	addSet(m, "test.large", 0, 5000)
+	other := make(appchilada.AggregateMap)
+	addSet(other, "test.small", 10, 30)
+	addSet(other, "test.large", 2500, 7500)
+	m.Merge(other)
+	// Members and sketches are merged, so shared members are counted once
+	if set := m.Sets()["test.small"]; set == nil || set.Cardinality != 30 {
+		t.Errorf("Expected set with cardinality %d for 'test.small', got %v", 30, set)
+	}
+	if set := m.Sets()["test.large"]; set == nil || set.Cardinality < 7100 || set.Cardinality > 7900 {
+		t.Errorf("Expected set with cardinality of about %d for 'test.large', got %v", 7500, set)
+	}
+}
+
+func TestShardedMap(t *testing.T) {
+	s := appchilada.NewShardedMap(4)
+	for i := 0; i < 100; i++ {
+		s.AddEvent(&appchilada.Event{Type: appchilada.EventTypeCount, Name: "test." + strconv.Itoa(i%10), Value: 1})
+		s.AddEvent(&appchilada.Event{Type: appchilada.EventTypeGauge, Name: "test.gauge", Value: int64(i)})
+	}
+	m := s.Flush()
+	counts := m.Counts()
+	if len(counts) != 10 {
+		t.Errorf("Expected counts to be of length %d, got %d", 10, len(counts))
+	}
+	if count := counts["test.3"]; count == nil || count.Value != 10 {
+		t.Errorf("Expected count with value %d for 'test.3', got %v", 10, count)
+	}
+	if gauge := m.Gauges()["test.gauge"]; gauge == nil || gauge.Value != 99 {
+		t.Errorf("Expected gauge with value %d for 'test.gauge', got %v", 99, gauge)
+	}
+	// Gauges are kept by their shard for the next interval
+	m = s.Flush()
+	if len(m.Counts()) != 0 {
+		t.Errorf("Expected no counts after flush, got %d", len(m.Counts()))
+	}
+	if gauge := m.Gauges()["test.gauge"]; gauge == nil || gauge.Value != 99 {
+		t.Errorf("Expected gauge with value %d for 'test.gauge' after flush, got %v", 99, gauge)
+	}
+}
+
+// Backend that keeps the stored maps in memory
+type memoryBackend struct {
+	stored chan appchilada.AggregateMap
+}
+
+func (backend *memoryBackend) Open() os.Error {
+	return nil
+}
+
+func (backend *memoryBackend) Store(m appchilada.AggregateMap, t *time.Time) os.Error {
+	backend.stored <- m
+	return nil
+}
+
+func (backend *memoryBackend) Read(name string, interval appchilada.Interval, filter appchilada.TagFilter) ([]*appchilada.Results, os.Error) {
+	return nil, nil
+}
+
+func (backend *memoryBackend) Names() ([]string, os.Error) {
+	return nil, nil
+}
+
+func (backend *memoryBackend) Close() os.Error {
+	return nil
+}
+
+func TestAggregatorQuit(t *testing.T) {
+	eventChan := make(chan appchilada.Event)
+	backend := &memoryBackend{make(chan appchilada.AggregateMap, 1)}
+	quit := make(chan chan bool)
+	go appchilada.Aggregator(eventChan, backend, 3600, quit)
+	for _, event := range countEvents {
+		eventChan <- event
+	}
+	done := make(chan bool)
+	quit <- done
+	<-done
+	select {
+	case m := <-backend.stored:
+		if count := m.Counts()["test.foo"]; count == nil || count.Value != 5 {
+			t.Errorf("Expected count with value %d for 'test.foo', got %v", 5, count)
+		}
+	default:
+		t.Errorf("Expected remaining events to be stored when quitting")
+	}
+}
+
+// Backend that blocks stores until released
+type gatedBackend struct {
+	memoryBackend
+	// Receives a value when a store starts waiting
+	storing chan bool
+	release chan bool
+}
+
+func (backend *gatedBackend) Store(m appchilada.AggregateMap, t *time.Time) os.Error {
+	backend.storing <- true
+	<-backend.release
+	backend.stored <- m
+	return nil
+}
+
+// Backend that fails the first stores
+type failingBackend struct {
+	memoryBackend
+	failures int
+}
+
+func (backend *failingBackend) Store(m appchilada.AggregateMap, t *time.Time) os.Error {
+	if backend.failures > 0 {
+		backend.failures--
+		return os.NewError("backend unavailable")
+	}
+	backend.stored <- m
+	return nil
+}
+
+// Backend that fails to open the first times
+type unreachableBackend struct {
+	memoryBackend
+	failures int
+}
+
+func (backend *unreachableBackend) Open() os.Error {
+	if backend.failures > 0 {
+		backend.failures--
+		return os.NewError("backend unreachable")
+	}
+	return nil
+}
+
+// Create a map with a single count to identify it
+func countMap(value int64) appchilada.AggregateMap {
+	m := make(appchilada.AggregateMap)
+	m.AddEvent(&appchilada.Event{Type: appchilada.EventTypeCount, Name: "n", Value: value})
+	return m
+}
+
+func TestRetryBackendRetriesInOrder(t *testing.T) {
+	defer func(delay int64) { appchilada.RetryDelay = delay }(appchilada.RetryDelay)
+	appchilada.RetryDelay = 0
+	backend := &failingBackend{memoryBackend{make(chan appchilada.AggregateMap, 3)}, 2}
+	r := appchilada.NewRetryBackend(backend, 10)
+	r.Open()
+	for i := int64(1); i <= 3; i++ {
+		r.Store(countMap(i), time.LocalTime())
+	}
+	r.Close()
+	for i := int64(1); i <= 3; i++ {
+		if count := (<-backend.stored).Counts()["n"]; count.Value != i {
+			t.Errorf("Expected stored aggregation %d, got %d", i, count.Value)
+		}
+	}
+}
+
+func TestRetryBackendDropsOldest(t *testing.T) {
+	backend := &gatedBackend{memoryBackend{make(chan appchilada.AggregateMap, 4)}, make(chan bool, 4), make(chan bool)}
+	r := appchilada.NewRetryBackend(backend, 2)
+	r.Open()
+	r.Store(countMap(1), time.LocalTime())
+	<-backend.storing
+	for i := int64(2); i <= 4; i++ {
+		r.Store(countMap(i), time.LocalTime())
+	}
+	// The aggregation being stored is neither dropped nor counted against the queue size
+	if r.QueueDepth() != 3 || r.Dropped() != 1 {
+		t.Errorf("Expected queue depth %d and %d dropped, got %d and %d", 3, 1, r.QueueDepth(), r.Dropped())
+	}
+	close(backend.release)
+	r.Close()
+	var stored []int64
+	for len(backend.stored) > 0 {
+		stored = append(stored, (<-backend.stored).Counts()["n"].Value)
+	}
+	if fmt.Sprint(stored) != "[1 3 4]" {
+		t.Errorf("Expected aggregations %v to be stored, got %v", []int64{1, 3, 4}, stored)
+	}
+}
+
+func TestSpoolBackendReplaysAfterRestart(t *testing.T) {
+	defer func(delay int64) { appchilada.RetryDelay = delay }(appchilada.RetryDelay)
+	appchilada.RetryDelay = 0
+	dir, err := ioutil.TempDir("", "appchilada")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/spool"
+
+	// Stored aggregations are not replayed
+	stored := make(chan appchilada.AggregateMap, 2)
+	s := appchilada.NewSpoolBackend(&memoryBackend{stored}, path)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	s.Store(countMap(1), time.LocalTime())
+	<-stored
+	s.Close()
+
+	// Aggregations are kept while the backend fails
+	s = appchilada.NewSpoolBackend(&failingBackend{memoryBackend{stored}, 1 << 30}, path)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	m := countMap(2)
+	m.AddEvent(&appchilada.Event{Type: appchilada.EventTypeSet, Name: "n", Member: "a"})
+	m.AddEvent(&appchilada.Event{Type: appchilada.EventTypeSet, Name: "n", Member: "b"})
+	s.Store(m, time.LocalTime())
+	s.Close()
+
+	s = appchilada.NewSpoolBackend(&memoryBackend{stored}, path)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	replayed := <-stored
+	s.Close()
+	if count := replayed.Counts()["n"]; count == nil || count.Value != 2 {
+		t.Errorf("Expected replayed count with value %d, got %v", 2, count)
+	}
+	if set := replayed.Sets()["n"]; set == nil || set.Cardinality != 2 {
+		t.Errorf("Expected replayed set with cardinality %d, got %v", 2, set)
+	}
+	if len(stored) != 0 {
+		t.Errorf("Expected aggregations to be stored once, got %d more", len(stored))
+	}
+}
+
+func TestSpoolBackendSkipsCorruptRecords(t *testing.T) {
+	defer func(delay int64) { appchilada.RetryDelay = delay }(appchilada.RetryDelay)
+	appchilada.RetryDelay = 0
+	dir, err := ioutil.TempDir("", "appchilada")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/spool"
+
+	stored := make(chan appchilada.AggregateMap, 3)
+	s := appchilada.NewSpoolBackend(&failingBackend{memoryBackend{stored}, 1 << 30}, path)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for value := int64(1); value <= 3; value++ {
+		s.Store(countMap(value), time.LocalTime())
+	}
+	s.Close()
+
+	// Damage the payload of the second record, its header starts after the first record
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := 8 + int(data[0])<<24 | int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	data[second+8] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s = appchilada.NewSpoolBackend(&memoryBackend{stored}, path)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []int64{1, 3} {
+		select {
+		case m := <-stored:
+			if count := m.Counts()["n"]; count == nil || count.Value != value {
+				t.Errorf("Expected replayed count with value %d, got %v", value, count)
+			}
+		case <-time.After(1e9):
+			t.Fatalf("Expected replayed count with value %d", value)
+		}
+	}
+	s.Close()
+	if len(stored) != 0 {
+		t.Errorf("Expected the corrupt aggregation to be skipped, got %d more", len(stored))
+	}
+}
+
+func TestMultiBackendStoresIndependently(t *testing.T) {
+	failing := &failingBackend{memoryBackend{make(chan appchilada.AggregateMap, 1)}, 1}
+	working := &memoryBackend{make(chan appchilada.AggregateMap, 1)}
+	multi := &appchilada.MultiBackend{Backends: []appchilada.Backend{failing, working}}
+	if err := multi.Store(countMap(1), time.LocalTime()); err == nil {
+		t.Errorf("Expected an error from the failing backend")
+	}
+	if len(working.stored) != 1 {
+		t.Errorf("Expected the aggregation to be stored in the working backend")
+	}
+}
+
+func TestMultiBackendOpensSecondaryInBackground(t *testing.T) {
+	defer func(delay int64) { appchilada.RetryDelay = delay }(appchilada.RetryDelay)
+	appchilada.RetryDelay = 0
+	primary := &memoryBackend{make(chan appchilada.AggregateMap, 1)}
+	secondary := &unreachableBackend{memoryBackend{make(chan appchilada.AggregateMap, 1)}, 2}
+	multi := &appchilada.MultiBackend{Backends: []appchilada.Backend{primary, appchilada.NewRetryBackend(secondary, 10)}}
+	if err := multi.Open(); err != nil {
+		t.Fatalf("Expected only the primary backend to be required, got %v", err)
+	}
+	multi.Store(countMap(1), time.LocalTime())
+	select {
+	case <-secondary.stored:
+	case <-time.After(1e9):
+		t.Errorf("Expected the aggregation to be stored once the secondary backend is open")
+	}
+	multi.Close()
+
+	unreachable := &unreachableBackend{memoryBackend{make(chan appchilada.AggregateMap, 1)}, 1}
+	multi = &appchilada.MultiBackend{Backends: []appchilada.Backend{appchilada.NewRetryBackend(unreachable, 10), primary}}
+	if err := multi.Open(); err == nil {
+		t.Errorf("Expected an error when the primary backend cannot be opened")
+	}
+}
+
+// Timing events of many series, which are the most expensive to reduce
+var benchmarkEvents = makeBenchmarkEvents(1000)
+
+func makeBenchmarkEvents(n int) []appchilada.Event {
+	events := make([]appchilada.Event, n)
+	for i := range events {
+		events[i] = appchilada.Event{
+			Type:  appchilada.EventTypeTiming,
+			Name:  "bench." + strconv.Itoa(i%100),
+			Value: int64(i * 7),
+			Tags:  map[string]string{"host": "host" + strconv.Itoa(i%5), "region": "eu"},
+		}
+	}
+	return events
+}
+
+func BenchmarkAggregateMap(b *testing.B) {
+	m := make(appchilada.AggregateMap)
+	for i := 0; i < b.N; i++ {
+		m.AddEvent(&benchmarkEvents[i%len(benchmarkEvents)])
+	}
+}
+
+// Run with -test.cpu=1,2,4,8 to see the sharded map scale with the number of processors
+func benchmarkShardedMap(b *testing.B, shards int) {
+	s := appchilada.NewShardedMap(shards)
+	for i := 0; i < b.N; i++ {
+		s.AddEvent(&benchmarkEvents[i%len(benchmarkEvents)])
+	}
+	// Wait until all shards reduced their events
+	s.Flush()
+}
+
+func BenchmarkShardedMap1(b *testing.B) {
+	benchmarkShardedMap(b, 1)
+}
+
+func BenchmarkShardedMap2(b *testing.B) {
+	benchmarkShardedMap(b, 2)
+}
+
+func BenchmarkShardedMap4(b *testing.B) {
+	benchmarkShardedMap(b, 4)
+}
+
+func BenchmarkShardedMap8(b *testing.B) {
+	benchmarkShardedMap(b, 8)
+}
+
+// Compare with BenchmarkAggregator to see the cost of passing events to the shards
+func benchmarkShardedAggregator(b *testing.B, shards int) {
+	eventChan := make(chan appchilada.Event, 10000)
+	backend := &memoryBackend{make(chan appchilada.AggregateMap, 10)}
+	quit := make(chan chan bool)
+	if shards > 1 {
+		go appchilada.ShardedAggregator(eventChan, backend, 3600, shards, quit)
+	} else {
+		go appchilada.Aggregator(eventChan, backend, 3600, quit)
+	}
+	for i := 0; i < b.N; i++ {
+		eventChan <- benchmarkEvents[i%len(benchmarkEvents)]
+	}
+	// Wait until all events were reduced and stored
+	done := make(chan bool)
+	quit <- done
+	<-done
+}
+
+func BenchmarkAggregator(b *testing.B) {
+	benchmarkShardedAggregator(b, 1)
+}
+
+func BenchmarkShardedAggregator2(b *testing.B) {
+	benchmarkShardedAggregator(b, 2)
+}
+
+func BenchmarkShardedAggregator4(b *testing.B) {
+	benchmarkShardedAggregator(b, 4)
+}
+
+func BenchmarkShardedAggregator8(b *testing.B) {
+	benchmarkShardedAggregator(b, 8)
+}
+
+func TestIntervalStart(t *testing.T) {
+	if start := appchilada.IntervalStart(1323017545, 10); start != 1323017540 {
+		t.Errorf("Expected interval start %d, got %d", 1323017540, start)
+	}
+	if start := appchilada.IntervalStart(1323017540, 10); start != 1323017540 {
+		t.Errorf("Expected interval start %d, got %d", 1323017540, start)
+	}
 }
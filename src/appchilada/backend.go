@@ -8,11 +8,48 @@ import (
 type Backend interface {
 	Open() os.Error
 	Store(m AggregateMap, t *time.Time) os.Error
-	Read(name string, interval Interval) (data *Results, err os.Error)
+	Read(name string, interval Interval, filter TagFilter) (data []*Results, err os.Error)
 	Names() (names []string, err os.Error)
+	// Release the backend after the last Store
+	Close() os.Error
+}
+
+// Selects series by tag when reading results
+// An empty filter selects the totals of all series of a name,
+// an empty value groups the results by all values of the tag key
+type TagFilter struct {
+	Key   string
+	Value string
+}
+
+func (filter TagFilter) String() string {
+	if filter.Key == "" {
+		return ""
+	}
+	return filter.Key + tagValueSeparator + filter.Value
 }
 
 type Results struct {
+	Name string
+	// Tag of the series, empty for the totals of all series
+	Filter TagFilter
+	// Average counts
+	Rows []*Result
+	// Average gauge values
+	Gauges []*Result
+	// Average set cardinalities
+	Sets []*Result
+	// Average timings
+	Timings []*Result
+	// Variance and standard deviation of timings
+	Variances []*Result
+	StdDevs   []*Result
+	// Timing percentiles, one series per configured percentile
+	Percentiles []*Series
+}
+
+// A named series of results
+type Series struct {
 	Name string
 	Rows []*Result
 }
@@ -5,6 +5,7 @@ import (
 	"time"
 	"json"
 	"log"
+	"strconv"
 	"couch-go.googlecode.com/hg"
 )
 
@@ -14,17 +15,34 @@ const designDocument = `
 	"language": "javascript",
 	"views": {
 		"counts": {
-			"map": "function(doc) {\n if (!doc.Counts || !doc.Timings) return;\n for(key in doc.Counts) {\n  emit([key, doc.Year, doc.Month, doc.Day, doc.Hour, doc.Minute, doc.Second], doc.Counts[key].Value);\n }\n}",
+			"map": "function(doc) {\n var time = [doc.Year, doc.Month, doc.Day, doc.Hour, doc.Minute, doc.Second];\n if (doc.CountTotals) {\n  for (key in doc.CountTotals) {\n   var parts = key.split(';');\n   var tag = (parts[1] || '').split('=');\n   emit([parts[0], tag[0], tag[1] || ''].concat(time), doc.CountTotals[key]);\n  }\n  return;\n }\n // Documents stored without totals emit every series\n for(key in doc.Counts) {\n  var parts = key.split(';');\n  var value = doc.Counts[key].Value;\n  emit([parts[0], '', ''].concat(time), value);\n  for (var i = 1; i < parts.length; i++) {\n   var tag = parts[i].split('=');\n   emit([parts[0], tag[0], tag[1] || ''].concat(time), value);\n  }\n }\n}",
+			"reduce": "_stats"
+		},
+		"gauges": {
+			"map": "function(doc) {\n var time = [doc.Year, doc.Month, doc.Day, doc.Hour, doc.Minute, doc.Second];\n if (doc.GaugeTotals) {\n  for (key in doc.GaugeTotals) {\n   var parts = key.split(';');\n   var tag = (parts[1] || '').split('=');\n   emit([parts[0], tag[0], tag[1] || ''].concat(time), doc.GaugeTotals[key]);\n  }\n  return;\n }\n // Documents stored without totals emit every series\n for(key in doc.Gauges) {\n  var parts = key.split(';');\n  var value = doc.Gauges[key].Value;\n  emit([parts[0], '', ''].concat(time), value);\n  for (var i = 1; i < parts.length; i++) {\n   var tag = parts[i].split('=');\n   emit([parts[0], tag[0], tag[1] || ''].concat(time), value);\n  }\n }\n}",
+			"reduce": "_stats"
+		},
+		"timings": {
+			"map": "function(doc) {\n if (!doc.Timings) return;\n var time = [doc.Year, doc.Month, doc.Day, doc.Hour, doc.Minute, doc.Second];\n for(key in doc.Timings) {\n  var parts = key.split(';');\n  var value = {Sum: doc.Timings[key].Sum, Count: doc.Timings[key].Count, Min: doc.Timings[key].Min, Max: doc.Timings[key].Max, SumSquares: doc.Timings[key].SumSquares || 0, Histogram: doc.Timings[key].Histogram || {}};\n  emit([parts[0], '', ''].concat(time), value);\n  for (var i = 1; i < parts.length; i++) {\n   var tag = parts[i].split('=');\n   emit([parts[0], tag[0], tag[1] || ''].concat(time), value);\n  }\n }\n}",
+			"reduce": "function(keys, values, rereduce) {\n // Histograms are coarsened by merging buckets to stay below the CouchDB reduce limit\n // Scale is the number of buckets merged into one, the merged bucket keeps the middle index\n var maxBuckets = 200;\n var result = {Sum: 0, Count: 0, Min: null, Max: null, SumSquares: 0, Histogram: {}, Scale: 1};\n for (var i = 0; i < values.length; i++) {\n  result.Scale = Math.max(result.Scale, values[i].Scale || 1);\n }\n var merge = function(histogram, into) {\n  for (var b in histogram) {\n   var index = parseInt(b, 10);\n   if (index > 0 && result.Scale > 1) index = Math.ceil(index / result.Scale) * result.Scale - result.Scale / 2;\n   into[index] = (into[index] || 0) + histogram[b];\n  }\n };\n for (var i = 0; i < values.length; i++) {\n  var v = values[i];\n  result.Sum += v.Sum;\n  result.Count += v.Count;\n  result.SumSquares += v.SumSquares;\n  if (result.Min === null || v.Min < result.Min) result.Min = v.Min;\n  if (result.Max === null || v.Max > result.Max) result.Max = v.Max;\n  merge(v.Histogram, result.Histogram);\n }\n for (;;) {\n  var buckets = 0;\n  for (var b in result.Histogram) buckets++;\n  if (buckets <= maxBuckets) return result;\n  var histogram = result.Histogram;\n  result.Scale *= 2;\n  result.Histogram = {};\n  merge(histogram, result.Histogram);\n }\n}"
+		},
+		"sets": {
+			"map": "function(doc) {\n var time = [doc.Year, doc.Month, doc.Day, doc.Hour, doc.Minute, doc.Second];\n if (doc.SetTotals) {\n  for (key in doc.SetTotals) {\n   var parts = key.split(';');\n   var tag = (parts[1] || '').split('=');\n   emit([parts[0], tag[0], tag[1] || ''].concat(time), doc.SetTotals[key]);\n  }\n  return;\n }\n // Documents stored without totals emit every series\n for(key in doc.Sets) {\n  var parts = key.split(';');\n  var value = doc.Sets[key].Cardinality;\n  emit([parts[0], '', ''].concat(time), value);\n  for (var i = 1; i < parts.length; i++) {\n   var tag = parts[i].split('=');\n   emit([parts[0], tag[0], tag[1] || ''].concat(time), value);\n  }\n }\n}",
 			"reduce": "_stats"
 		},
 		"names": {
-			"map": "function(doc) {\n if (!doc.Counts || !doc.Timings) return;\n for(key in doc.Counts) {\n  emit(key, null);\n }\n}",
+			"map": "function(doc) {\n var types = [doc.Counts, doc.Timings, doc.Gauges, doc.Sets];\n for (var t = 0; t < types.length; t++) {\n  for(key in types[t]) {\n   var parts = key.split(';');\n   emit([parts[0], '', ''], null);\n   for (var i = 1; i < parts.length; i++) {\n    var tag = parts[i].split('=');\n    emit([parts[0], tag[0], tag[1] || ''], null);\n   }\n  }\n }\n}",
 			"reduce": "function(keys, values, rereduce) {   \n    return true;\n    }\n"
+		},
+		"times": {
+			"map": "function(doc) {\n if (doc.Year) emit([doc.Year, doc.Month, doc.Day, doc.Hour, doc.Minute, doc.Second], doc._rev);\n}"
 		}
 	}
 }
 `
 
+const designDocumentId = "_design/appchilada"
+
 const (
 	minuteSeconds = 60
 	hourSeconds   = 60 * minuteSeconds
@@ -35,9 +53,19 @@ type CouchDbBackend struct {
 	Host         string
 	Port         string
 	DatabaseName string
-	db           couch.Database
+	// Seconds records are kept, 0 keeps them forever
+	Retention int64
+	db        couch.Database
+	// Stops pruning old records
+	quit chan bool
 }
 
+// Seconds between deleting records older than the retention
+const pruneInterval = hourSeconds
+
+// Maximum number of records deleted per query
+const pruneLimit = 1000
+
 type couchDbRecord struct {
 	// Time of the aggregation
 	Year                 int64
@@ -47,6 +75,12 @@ type couchDbRecord struct {
 	Counts map[string]*Count
 	// Aggregated timings
 	Timings map[string]*Timing
+	// Last gauge values
+	Gauges map[string]*Gauge
+	// Unique set members
+	Sets map[string]*Set
+	// Sums of all series by name and by name and tag (see AggregateMap.Totals)
+	CountTotals, GaugeTotals, SetTotals map[string]float64
 }
 
 func (backend *CouchDbBackend) Open() os.Error {
@@ -58,27 +92,150 @@ func (backend *CouchDbBackend) Open() os.Error {
 	if err := json.Unmarshal([]byte(designDocument), &m); err != nil {
 		return err
 	}
-	if id, rev, err := db.InsertWith(m, "_design/appchilada"); err != nil {
-		log.Printf("Error inserting design: %v", err)
+	if id, rev, err := db.InsertWith(m, designDocumentId); err != nil {
+		// The design document exists, update it to get new views
+		if rev, err = updateDesignDocument(db, m); err != nil {
+			log.Printf("Error updating design: %v", err)
+		} else {
+			log.Printf("Design updated as %s / %s", designDocumentId, rev)
+		}
 	} else {
 		log.Printf("Design inserted as %s / %s", id, rev)
 	}
 
 	backend.db = db
+	if backend.Retention > 0 {
+		backend.quit = make(chan bool)
+		go backend.pruneLoop()
+	}
+	return nil
+}
+
+// CouchDB is accessed with a request per operation, so there is no connection to close
+func (backend *CouchDbBackend) Close() os.Error {
+	if backend.quit != nil {
+		close(backend.quit)
+		backend.quit = nil
+	}
 	return nil
 }
 
-func (backend *CouchDbBackend) Store(m AggregateMap, t *time.Time) os.Error {
+func (backend *CouchDbBackend) pruneLoop() {
+	timer := time.Tick(pruneInterval * 1e9)
+	for {
+		if err := backend.Prune(); err != nil {
+			log.Printf("Error deleting old records: %v", err)
+		}
+		select {
+		case _ = <-timer:
+		case _ = <-backend.quit:
+			return
+		}
+	}
+}
+
+type idRows struct {
+	Rows []struct {
+		Id    string
+		Value string
+	}
+}
+
+// Delete all records older than the retention
+func (backend *CouchDbBackend) Prune() os.Error {
+	if backend.Retention <= 0 {
+		return nil
+	}
+	t := time.SecondsToLocalTime(time.Seconds() - backend.Retention)
+	opts := map[string]interface{}{
+		"endkey":        []interface{}{t.Year, t.Month, t.Day, t.Hour, t.Minute, t.Second},
+		"inclusive_end": false,
+		"limit":         pruneLimit,
+	}
+	for {
+		results := &idRows{}
+		if err := backend.db.Query(designDocumentId+"/_view/times", opts, results); err != nil {
+			return err
+		}
+		for _, row := range results.Rows {
+			if err := backend.db.Delete(row.Id, row.Value); err != nil {
+				return err
+			}
+		}
+		if len(results.Rows) > 0 {
+			log.Printf("Deleted %d records older than %s", len(results.Rows), t)
+		}
+		if len(results.Rows) < pruneLimit {
+			return nil
+		}
+	}
+	panic("unreachable")
+}
+
+// Replace an existing design document with the given document
+func updateDesignDocument(db couch.Database, m map[string]interface{}) (string, os.Error) {
+	existing := map[string]interface{}{}
+	if err := db.Retrieve(designDocumentId, &existing); err != nil {
+		return "", err
+	}
+	rev, _ := existing["_rev"].(string)
+	return db.EditWith(m, designDocumentId, rev)
+}
+
+// Number of attempts to merge an aggregation into a record that is changed concurrently
+const storeAttempts = 3
+
+// Store an aggregation as the record of its interval, or merge it into the existing record
+// Late events and points are stored after their interval, every interval has one record so that
+// the views don't average partial aggregations
+func (backend *CouchDbBackend) Store(m AggregateMap, t *time.Time) (err os.Error) {
 	if len(m) == 0 {
 		return nil
 	}
-	r := &couchDbRecord{t.Year, t.Month, t.Day, t.Hour, t.Minute, t.Second, m.Counts(), m.Timings()}
-	id, _, err := backend.db.Insert(r)
+	id := strconv.Itoa64(t.Seconds())
+	for attempt := 0; attempt < storeAttempts; attempt++ {
+		existing := map[string]interface{}{}
+		var rev string
+		if backend.db.Retrieve(id, &existing) == nil {
+			rev, _ = existing["_rev"].(string)
+		}
+		if rev == "" {
+			if _, _, err = backend.db.InsertWith(newCouchDbRecord(m, t), id); err == nil {
+				log.Printf("Inserted doc as: %s", id)
+				return nil
+			}
+			// Retry if the record was inserted concurrently
+			continue
+		}
+		var merged AggregateMap
+		if merged, err = recordAggregates(existing); err != nil {
+			return err
+		}
+		merged.Merge(m)
+		if _, err = backend.db.EditWith(newCouchDbRecord(merged, t), id, rev); err == nil {
+			log.Printf("Merged into doc: %s", id)
+			return nil
+		}
+	}
+	return err
+}
+
+func newCouchDbRecord(m AggregateMap, t *time.Time) *couchDbRecord {
+	return &couchDbRecord{t.Year, t.Month, t.Day, t.Hour, t.Minute, t.Second, m.Counts(), m.Timings(), m.Gauges(), m.Sets(),
+		m.Totals(EventTypeCount), m.Totals(EventTypeGauge), m.Totals(EventTypeSet)}
+}
+
+// Restore the aggregates of a retrieved record
+func recordAggregates(doc map[string]interface{}) (AggregateMap, os.Error) {
+	data, err := json.Marshal(doc)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	log.Printf("Inserted doc as: %s", id)
-	return nil
+	r := &couchDbRecord{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+	return restoreAggregates(r.Counts, r.Timings, r.Gauges, r.Sets), nil
 }
 
 type countRow struct {
@@ -90,8 +247,21 @@ type countRows struct {
 	Rows []countRow
 }
 
+type timingRow struct {
+	Key   []interface{}
+	Value struct {
+		Sum, Count, Min, Max float64
+		SumSquares           float64
+		Histogram            Histogram
+	}
+}
+
+type timingRows struct {
+	Rows []timingRow
+}
+
 type keyValueRow struct {
-	Key   string
+	Key   []interface{}
 	Value interface{}
 }
 
@@ -125,7 +295,126 @@ func parseTimeFromKey(key []interface{}) *time.Time {
 	return t
 }
 
-func (backend *CouchDbBackend) Read(name string, interval Interval) (data *Results, err os.Error) {
+func (backend *CouchDbBackend) Read(name string, interval Interval, filter TagFilter) (data []*Results, err os.Error) {
+	if filter.Key == "" || filter.Value != "" {
+		results, err := backend.readResults(name, interval, filter)
+		if err != nil {
+			return nil, err
+		}
+		return []*Results{results}, nil
+	}
+	// Group by reading the results for each value of the tag
+	values, err := backend.tagValues(name, filter.Key)
+	if err != nil {
+		return nil, err
+	}
+	data = make([]*Results, 0, len(values))
+	for _, value := range values {
+		results, err := backend.readResults(name, interval, TagFilter{Key: filter.Key, Value: value})
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, results)
+	}
+	return
+}
+
+// Read the results of all types for a name and tag filter
+func (backend *CouchDbBackend) readResults(name string, interval Interval, filter TagFilter) (data *Results, err os.Error) {
+	data = &Results{Name: name, Filter: filter}
+	if data.Rows, err = backend.readStats("counts", data, interval); err != nil {
+		return nil, err
+	}
+	if data.Gauges, err = backend.readStats("gauges", data, interval); err != nil {
+		return nil, err
+	}
+	if data.Sets, err = backend.readStats("sets", data, interval); err != nil {
+		return nil, err
+	}
+	if err = backend.readTimings(data, interval); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Get all values of a tag for a name
+func (backend *CouchDbBackend) tagValues(name string, key string) ([]string, os.Error) {
+	results := &keyValueRows{}
+	opts := map[string]interface{}{
+		"startkey":    []interface{}{name, key},
+		"endkey":      []interface{}{name, key, map[string]interface{}{}},
+		"group_level": 3,
+	}
+	if err := backend.db.Query(designDocumentId+"/_view/names", opts, results); err != nil {
+		return nil, err
+	}
+	values := make([]string, 0, len(results.Rows))
+	for _, row := range results.Rows {
+		if value, ok := row.Key[2].(string); ok {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// Read the average timings, variances and percentiles from the merged timings
+// The view coarsens merged histograms with many buckets, so percentiles of wide ranges are less accurate
+func (backend *CouchDbBackend) readTimings(data *Results, interval Interval) os.Error {
+	results := &timingRows{}
+	if err := backend.queryView("timings", data.Name, data.Filter, interval, results); err != nil {
+		return err
+	}
+	data.Timings = make([]*Result, 0, len(results.Rows))
+	data.Variances = make([]*Result, 0, len(results.Rows))
+	data.StdDevs = make([]*Result, 0, len(results.Rows))
+	data.Percentiles = make([]*Series, len(Percentiles))
+	for i, p := range Percentiles {
+		data.Percentiles[i] = &Series{Name: PercentileLabel(p), Rows: make([]*Result, 0, len(results.Rows))}
+	}
+	for _, row := range results.Rows {
+		if row.Key[0] != data.Name || row.Value.Count == 0 {
+			continue
+		}
+		t := parseTimeFromKey(row.Key[3:])
+		timing := &Timing{
+			Sum:        int64(row.Value.Sum),
+			Count:      int64(row.Value.Count),
+			Min:        int64(row.Value.Min),
+			Max:        int64(row.Value.Max),
+			SumSquares: row.Value.SumSquares,
+			Histogram:  row.Value.Histogram,
+		}
+		data.Timings = append(data.Timings, &Result{Value: timing.Avg(), Time: t})
+		data.Variances = append(data.Variances, &Result{Value: timing.Variance(), Time: t})
+		data.StdDevs = append(data.StdDevs, &Result{Value: timing.StdDev(), Time: t})
+		for i, p := range Percentiles {
+			data.Percentiles[i].Rows = append(data.Percentiles[i].Rows, &Result{Value: timing.Percentile(p), Time: t})
+		}
+	}
+	return nil
+}
+
+// Read the average of a _stats view for the name and filter of the results grouped by the interval
+// Records emit one total per name and tag, so the average is taken over the intervals of a group
+func (backend *CouchDbBackend) readStats(view string, data *Results, interval Interval) ([]*Result, os.Error) {
+	results := &countRows{}
+	if err := backend.queryView(view, data.Name, data.Filter, interval, results); err != nil {
+		return nil, err
+	}
+	rows := make([]*Result, 0, len(results.Rows))
+	for _, row := range results.Rows {
+		if row.Key[0] != data.Name {
+			continue
+		}
+		rows = append(rows, &Result{Value: row.Value["sum"] / row.Value["count"], Time: parseTimeFromKey(row.Key[3:])})
+	}
+	return rows, nil
+}
+
+// Query a view with keys of the form [name, tag key, tag value, year, month, day, hour, minute, second]
+// Totals of all series of a name are emitted with an empty tag key and value
+// The grouping level is chosen by the length of the interval
+func (backend *CouchDbBackend) queryView(view string, name string, filter TagFilter, interval Interval, results interface{}) os.Error {
 	var groupingLevel int
 	switch s := interval.Seconds(); {
 	case s >= 365*daySeconds:
@@ -147,8 +436,8 @@ func (backend *CouchDbBackend) Read(name string, interval Interval) (data *Resul
 	// Calculate start and endkey from interval
 	startTime := time.SecondsToLocalTime(interval.Start)
 	endTime := time.SecondsToLocalTime(interval.End)
-	startkey := []interface{}{name, startTime.Year}
-	endkey := []interface{}{name, endTime.Year}
+	startkey := []interface{}{name, filter.Key, filter.Value, startTime.Year}
+	endkey := []interface{}{name, filter.Key, filter.Value, endTime.Year}
 	switch {
 	case groupingLevel >= 3:
 		startkey = append(startkey, startTime.Month)
@@ -171,44 +460,31 @@ func (backend *CouchDbBackend) Read(name string, interval Interval) (data *Resul
 		endkey = append(endkey, "_")
 	}
 
-	results := &countRows{}
 	// Add startkey, endkey and dynamic grouping, limit etc.
 	opts := map[string]interface{}{
 		"startkey":    startkey,
 		"endkey":      endkey,
 		"descending":  false,
 		"group":       true,
-		"group_level": groupingLevel,
+		// Tag key and value are part of every group
+		"group_level": groupingLevel + 2,
 		"limit":       1000,
 	}
-	err = backend.db.Query("_design/appchilada/_view/counts", opts, results)
-	if err != nil {
-		return nil, err
-	} else {
-		data = &Results{
-			Name: name,
-			Rows: make([]*Result, 0, len(results.Rows)),
-		}
-		for _, row := range results.Rows {
-			if row.Key[0] != name {
-				continue
-			}
-			data.Rows = append(data.Rows, &Result{Value: row.Value["sum"] / row.Value["count"], Time: parseTimeFromKey(row.Key[1:])})
-		}
-	}
-	return
+	return backend.db.Query(designDocumentId+"/_view/"+view, opts, results)
 }
 
 func (backend *CouchDbBackend) Names() (names []string, err os.Error) {
 	results := &keyValueRows{}
-	opts := map[string]interface{}{"group": true}
-	err = backend.db.Query("_design/appchilada/_view/names", opts, results)
+	opts := map[string]interface{}{"group_level": 1}
+	err = backend.db.Query(designDocumentId+"/_view/names", opts, results)
 	if err != nil {
 		return nil, err
 	} else {
-		names = make([]string, len(results.Rows))
-		for i, row := range results.Rows {
-			names[i] = row.Key
+		names = make([]string, 0, len(results.Rows))
+		for _, row := range results.Rows {
+			if name, ok := row.Key[0].(string); ok {
+				names = append(names, name)
+			}
 		}
 	}
 	return
@@ -0,0 +1,112 @@
+package appchilada
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A backend that stores aggregations in all of its backends and reads from the first (primary) one
+// Backends are stored to in parallel, so a failing or slow backend does not keep the others from
+// storing. Wrap backends in a RetryBackend or SpoolBackend to retry them independently, these
+// also accept aggregations before they could be opened
+type MultiBackend struct {
+	Backends []Backend
+	// Closed to stop opening the backends that could not be opened
+	quit    chan bool
+	opening sync.WaitGroup
+}
+
+// Open all backends, fails only if the primary backend cannot be opened
+// The other backends are opened again in the background until they are open
+func (multi *MultiBackend) Open() os.Error {
+	if err := multi.Backends[0].Open(); err != nil {
+		return fmt.Errorf("backend 0: %v", err)
+	}
+	multi.quit = make(chan bool)
+	for i, backend := range multi.Backends[1:] {
+		if err := backend.Open(); err != nil {
+			log.Printf("Error opening backend %d, retrying in %d seconds: %v", i+1, RetryDelay, err)
+			multi.opening.Add(1)
+			go multi.open(i+1, backend)
+		}
+	}
+	return nil
+}
+
+// Open a backend with exponential backoff until it is open or the multi backend is closed
+func (multi *MultiBackend) open(i int, backend Backend) {
+	defer multi.opening.Done()
+	delay := RetryDelay
+	for {
+		select {
+		case <-time.After(delay * seconds):
+		case <-multi.quit:
+			return
+		}
+		err := backend.Open()
+		if err == nil {
+			log.Printf("Opened backend %d", i)
+			return
+		}
+		delay = nextRetryDelay(delay)
+		log.Printf("Error opening backend %d, retrying in %d seconds: %v", i, delay, err)
+	}
+}
+
+func (multi *MultiBackend) Store(m AggregateMap, t *time.Time) os.Error {
+	errs := make(chan os.Error, len(multi.Backends))
+	for i, backend := range multi.Backends {
+		go func(i int, backend Backend) {
+			if err := backend.Store(m, t); err != nil {
+				errs <- fmt.Errorf("backend %d: %v", i, err)
+			} else {
+				errs <- nil
+			}
+		}(i, backend)
+	}
+	return collectErrors(errs, len(multi.Backends))
+}
+
+func (multi *MultiBackend) Read(name string, interval Interval, filter TagFilter) (data []*Results, err os.Error) {
+	return multi.Backends[0].Read(name, interval, filter)
+}
+
+func (multi *MultiBackend) Names() (names []string, err os.Error) {
+	return multi.Backends[0].Names()
+}
+
+// Stop opening backends and close all backends, including those that could not be opened
+func (multi *MultiBackend) Close() os.Error {
+	if multi.quit != nil {
+		close(multi.quit)
+		multi.quit = nil
+	}
+	multi.opening.Wait()
+	errs := make(chan os.Error, len(multi.Backends))
+	for i, backend := range multi.Backends {
+		if err := backend.Close(); err != nil {
+			errs <- fmt.Errorf("backend %d: %v", i, err)
+		} else {
+			errs <- nil
+		}
+	}
+	return collectErrors(errs, len(multi.Backends))
+}
+
+// Receive n results and join the errors into one
+func collectErrors(errs chan os.Error, n int) os.Error {
+	var messages []string
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			messages = append(messages, err.String())
+		}
+	}
+	if len(messages) > 0 {
+		return os.NewError(strings.Join(messages, "; "))
+	}
+	return nil
+}
@@ -8,12 +8,29 @@ import (
 	"template"
 	"time"
 	"strconv"
+	"strings"
+	"sync"
 )
 
-var Development = false
+// Reload templates on every request, changed with SetDevelopment while handlers read it
+var development = false
+var developmentMutex sync.Mutex
 
-// Initialize HTTP server for frontend
-func ListenAndServeHttp(backend appchilada.Backend) os.Error {
+// Enable or disable reloading the templates on every request
+func SetDevelopment(enabled bool) {
+	developmentMutex.Lock()
+	defer developmentMutex.Unlock()
+	development = enabled
+}
+
+func isDevelopment() bool {
+	developmentMutex.Lock()
+	defer developmentMutex.Unlock()
+	return development
+}
+
+// Register the frontend handlers with the default HTTP server
+func Handle(backend appchilada.Backend) os.Error {
 	http.HandleFunc("/", indexHandler(backend))
 	http.HandleFunc("/show/", showHandler(backend))
 
@@ -25,10 +42,6 @@ func ListenAndServeHttp(backend appchilada.Backend) os.Error {
 		// Handle static files in /public served on /public (stripped prefix)
 		http.Handle("/assets/", http.StripPrefix("/assets", http.FileServer(http.Dir(dir))))
 	}
-	log.Printf("Opening webserver on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		return err
-	}
 	return nil
 }
 
@@ -38,8 +51,12 @@ func getTemplateFunc(filename string) func() *template.Template {
 	if err != nil {
 		log.Fatalf("Error parsing template: %v", err)
 	}
+	// Handlers reparse the template concurrently
+	var mutex sync.Mutex
 	return func() *template.Template {
-		if Development {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if isDevelopment() {
 			t, err = template.ParseFile(filename)
 			if err != nil {
 				log.Printf("Error parsing template: %v", err)
@@ -85,13 +102,27 @@ func showHandler(backend appchilada.Backend) func(http.ResponseWriter, *http.Req
 			// Default to now
 			end = time.Seconds()
 		}
-		results, err := backend.Read(name, appchilada.Interval{start, end})
+		// Filter by a tag given as key=value or group by all values of a tag key
+		var filter appchilada.TagFilter
+		tag, group := r.Form.Get("tag"), r.Form.Get("group")
+		if i := strings.Index(tag, "="); i > 0 {
+			filter = appchilada.TagFilter{Key: tag[:i], Value: tag[i+1:]}
+		} else if group != "" {
+			filter = appchilada.TagFilter{Key: group}
+		}
+		results, err := backend.Read(name, appchilada.Interval{start, end}, filter)
 		if err != nil {
 			// TODO Output error in response
 			log.Printf("Error getting results for %s: %v", name, err)
 			return
 		}
-		if err := getTemplate().Execute(w, results); err != nil {
+		d := map[string]interface{}{
+			"Name":   name,
+			"Tag":    tag,
+			"Group":  group,
+			"Groups": results,
+		}
+		if err := getTemplate().Execute(w, d); err != nil {
 			log.Printf("Error executing template: %v", err)
 		}
 	}
@@ -0,0 +1,84 @@
+package appchilada
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Relative accuracy of values reconstructed from histogram buckets
+const histogramAccuracy = 0.01
+
+var (
+	histogramGamma    = (1 + histogramAccuracy) / (1 - histogramAccuracy)
+	histogramLogGamma = math.Log(histogramGamma)
+)
+
+// Percentiles that are calculated for timings
+var Percentiles = []float64{50, 90, 95, 99}
+
+// A mergeable histogram with logarithmic buckets for positive values
+// Bucket indexes are used as string keys to allow storing the histogram as JSON
+type Histogram map[string]int64
+
+// Add n occurrences of the value
+func (h Histogram) add(value int64, n int64) {
+	if n > 0 {
+		h[strconv.Itoa(bucketIndex(value))] += n
+	}
+}
+
+// Add the bucket counts of another histogram to this histogram
+func (h Histogram) merge(other Histogram) {
+	for key, count := range other {
+		h[key] += count
+	}
+}
+
+// Get the approximate value at the given quantile (between 0 and 1)
+func (h Histogram) Quantile(q float64) float64 {
+	indexes := make([]int, 0, len(h))
+	var total int64
+	for key, count := range h {
+		index, err := strconv.Atoi(key)
+		if err != nil {
+			continue
+		}
+		indexes = append(indexes, index)
+		total += count
+	}
+	if total == 0 {
+		return 0
+	}
+	sort.Ints(indexes)
+	rank := int64(q * float64(total-1))
+	var seen int64
+	for _, index := range indexes {
+		seen += h[strconv.Itoa(index)]
+		if seen > rank {
+			return bucketValue(index)
+		}
+	}
+	return bucketValue(indexes[len(indexes)-1])
+}
+
+// Get the bucket index for a value, all values below 1 share bucket 0
+func bucketIndex(value int64) int {
+	if value < 1 {
+		return 0
+	}
+	return int(math.Ceil(math.Log(float64(value))/histogramLogGamma)) + 1
+}
+
+// Get the representative value for a bucket index
+func bucketValue(index int) float64 {
+	if index == 0 {
+		return 0
+	}
+	return 2 * math.Pow(histogramGamma, float64(index-1)) / (histogramGamma + 1)
+}
+
+// Get a label like "p99" for a percentile
+func PercentileLabel(p float64) string {
+	return "p" + strconv.Ftoa64(p, 'f', -1)
+}
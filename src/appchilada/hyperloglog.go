@@ -0,0 +1,78 @@
+package appchilada
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+const (
+	// Number of bits of the hash used to select a register (standard error ~1.6%)
+	hllPrecision = 12
+	hllRegisters = 1 << hllPrecision
+)
+
+// A HyperLogLog sketch to estimate the number of unique values with fixed memory
+type hyperLogLog struct {
+	registers []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{make([]uint8, hllRegisters)}
+}
+
+func (h *hyperLogLog) add(value string) {
+	x := hashString(value)
+	index := x >> (64 - hllPrecision)
+	// Count leading zeros of the remaining bits, the guard bit limits the rank
+	w := x<<hllPrecision | 1<<(hllPrecision-1)
+	rank := uint8(1)
+	for w&(1<<63) == 0 {
+		rank++
+		w <<= 1
+	}
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+// Merge the registers of another sketch into this sketch
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	for i, rank := range other.registers {
+		if rank > h.registers[i] {
+			h.registers[i] = rank
+		}
+	}
+}
+
+// Estimate the number of unique values added to the sketch
+func (h *hyperLogLog) estimate() int64 {
+	m := float64(hllRegisters)
+	sum := 0.0
+	zeros := 0
+	for _, rank := range h.registers {
+		sum += math.Pow(2, -float64(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Use linear counting for small cardinalities
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
+
+// Hash a string with FNV-1a and mix the bits for a better distribution of the high bits
+func hashString(value string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(value))
+	x := hash.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb3f99f1a3c4b
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,82 @@
+package appchilada
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Seconds after an interval was stored in which late events are still merged into it
+// Events arriving later are rejected
+var LatenessWindow int64 = 60
+
+// Number of rejected late events
+var lateEventsRejected int64
+
+// Get the number of late events that were rejected since the start
+func LateEventsRejected() int64 {
+	return atomic.LoadInt64(&lateEventsRejected)
+}
+
+// Collects events with a timestamp of an interval that was already stored
+type lateEvents struct {
+	// Times of recent flushes in seconds, each flush ends an interval and starts the next
+	// The oldest is the start of the oldest interval
+	flushes []int64
+	// Late events by the start of their interval
+	buckets map[int64]AggregateMap
+}
+
+func newLateEvents(start int64) *lateEvents {
+	return &lateEvents{
+		flushes: []int64{start},
+		buckets: make(map[int64]AggregateMap),
+	}
+}
+
+// Check if an event has a timestamp before the last flush
+func (late *lateEvents) isLate(event *Event) bool {
+	return event.Time != 0 && event.Time < late.flushes[len(late.flushes)-1]
+}
+
+// Add a late event to the interval it belongs to, the event is rejected if it is too old
+func (late *lateEvents) add(event *Event, now int64) {
+	for i := 1; i < len(late.flushes); i++ {
+		if event.Time >= late.flushes[i-1] && event.Time < late.flushes[i] {
+			if now-late.flushes[i] > LatenessWindow {
+				break
+			}
+			m := late.buckets[late.flushes[i-1]]
+			if m == nil {
+				m = make(AggregateMap)
+				late.buckets[late.flushes[i-1]] = m
+			}
+			m.AddEvent(event)
+			return
+		}
+	}
+	RejectLateEvent(event, event.Time)
+}
+
+// Count and log an event with a time in an interval that was stored before the lateness window
+func RejectLateEvent(event *Event, t int64) {
+	atomic.AddInt64(&lateEventsRejected, 1)
+	log.Printf("Rejected late event %s with time %d", event.Name, t)
+}
+
+// Store the late events with the start of their interval and remember the time of the current flush
+// Backends merge them into the aggregation that was stored for the interval
+func (late *lateEvents) flush(backend Backend, now int64) {
+	for t, m := range late.buckets {
+		log.Printf("Merging %d late aggregates into interval %d", len(m), t)
+		if err := backend.Store(m, time.SecondsToLocalTime(t)); err != nil {
+			log.Printf("Error storing late aggregation: %s", err)
+		}
+	}
+	late.buckets = make(map[int64]AggregateMap)
+	late.flushes = append(late.flushes, now)
+	// Keep one flush before the window as the start of the oldest interval
+	for len(late.flushes) > 2 && now-late.flushes[1] > LatenessWindow {
+		late.flushes = late.flushes[1:]
+	}
+}
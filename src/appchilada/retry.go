@@ -0,0 +1,180 @@
+package appchilada
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Seconds before the first retry of a failed store, doubled with every failure up to RetryMaxDelay
+var RetryDelay int64 = 1
+var RetryMaxDelay int64 = 60
+
+// Double the delay after a failed retry
+func nextRetryDelay(delay int64) int64 {
+	if delay = delay * 2; delay > RetryMaxDelay {
+		return RetryMaxDelay
+	}
+	return delay
+}
+
+type storeRequest struct {
+	m AggregateMap
+	t *time.Time
+}
+
+// A backend that stores aggregations in order from a bounded queue
+// Failed stores are retried with exponential backoff, when the queue is full the oldest
+// aggregation that is not being stored is dropped. Aggregations are queued before the backend is opened and stored
+// once it is open
+type RetryBackend struct {
+	Backend
+	size    int
+	mutex   sync.Mutex
+	queue   []*storeRequest
+	// Aggregation the worker is storing, it is not counted against the queue size
+	storing *storeRequest
+	dropped int64
+	closed  bool
+	// Signals the worker that the queue changed
+	wake chan bool
+	// Closed when the worker stored all aggregations after closing, nil if the worker is not running
+	done chan bool
+}
+
+func NewRetryBackend(backend Backend, size int) *RetryBackend {
+	if size < 1 {
+		size = 1
+	}
+	return &RetryBackend{
+		Backend: backend,
+		size:    size,
+		wake:    make(chan bool, 1),
+	}
+}
+
+// Open the backend and start storing the queued aggregations
+func (r *RetryBackend) Open() os.Error {
+	if err := r.Backend.Open(); err != nil {
+		return err
+	}
+	done := make(chan bool)
+	r.mutex.Lock()
+	r.closed = false
+	r.done = done
+	r.mutex.Unlock()
+	go r.run(done)
+	return nil
+}
+
+// Add an aggregation to the queue, errors are handled by retrying
+func (r *RetryBackend) Store(m AggregateMap, t *time.Time) os.Error {
+	r.mutex.Lock()
+	first := 0
+	if len(r.queue) > 0 && r.queue[0] == r.storing {
+		first = 1
+	}
+	if len(r.queue)-first >= r.size {
+		queue := make([]*storeRequest, 0, len(r.queue))
+		queue = append(queue, r.queue[:first]...)
+		r.queue = append(queue, r.queue[first+1:]...)
+		r.dropped++
+		log.Printf("Retry queue full, dropped oldest aggregation")
+	}
+	r.queue = append(r.queue, &storeRequest{m, t})
+	r.mutex.Unlock()
+	r.signal()
+	return nil
+}
+
+// Get the number of aggregations waiting to be stored
+func (r *RetryBackend) QueueDepth() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.queue)
+}
+
+// Get the number of aggregations that were dropped because the queue was full
+func (r *RetryBackend) Dropped() int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.dropped
+}
+
+// Wait until all queued aggregations are stored and close the backend
+// Aggregations that were queued but never stored because the backend was not open are dropped
+func (r *RetryBackend) Close() os.Error {
+	r.mutex.Lock()
+	r.closed = true
+	done := r.done
+	r.done = nil
+	if done == nil && len(r.queue) > 0 {
+		log.Printf("Dropping %d aggregations of a backend that could not be opened", len(r.queue))
+		r.dropped += int64(len(r.queue))
+		r.queue = nil
+	}
+	r.mutex.Unlock()
+	if done != nil {
+		r.signal()
+		<-done
+	}
+	return r.Backend.Close()
+}
+
+func (r *RetryBackend) signal() {
+	select {
+	case r.wake <- true:
+	default:
+	}
+}
+
+func (r *RetryBackend) run(done chan bool) {
+	delay := RetryDelay
+	for {
+		request := r.next()
+		if request == nil {
+			close(done)
+			return
+		}
+		if err := r.Backend.Store(request.m, request.t); err != nil {
+			log.Printf("Error storing aggregation, retrying in %d seconds with %d queued and %d dropped: %s",
+				delay, r.QueueDepth(), r.Dropped(), err)
+			time.Sleep(delay * seconds)
+			delay = nextRetryDelay(delay)
+			continue
+		}
+		delay = RetryDelay
+		r.remove(request)
+	}
+}
+
+// Get the oldest aggregation, waiting until there is one
+// Returns nil if the queue is empty and closed
+func (r *RetryBackend) next() *storeRequest {
+	for {
+		r.mutex.Lock()
+		if len(r.queue) > 0 {
+			request := r.queue[0]
+			r.storing = request
+			r.mutex.Unlock()
+			return request
+		}
+		closed := r.closed
+		r.mutex.Unlock()
+		if closed {
+			return nil
+		}
+		<-r.wake
+	}
+}
+
+// Remove a stored aggregation, it is the first in the queue because it is never dropped while storing
+func (r *RetryBackend) remove(request *storeRequest) {
+	r.mutex.Lock()
+	if len(r.queue) > 0 && r.queue[0] == request {
+		r.queue = r.queue[1:]
+	}
+	r.storing = nil
+	r.mutex.Unlock()
+}
@@ -0,0 +1,100 @@
+package appchilada
+
+// Events are sent to the shards in batches to keep the channel overhead per event low
+const (
+	shardBatch  = 64
+	shardBuffer = 16
+)
+
+// A worker that reduces the events of its share of names into its own map
+type shard struct {
+	events chan []Event
+	flush  chan chan AggregateMap
+}
+
+func (s *shard) run() {
+	m := make(AggregateMap)
+	for {
+		select {
+		case batch := <-s.events:
+			m.addEvents(batch)
+		case reply := <-s.flush:
+			// Reduce events that were sent before the flush
+			for drained := false; !drained; {
+				select {
+				case batch := <-s.events:
+					m.addEvents(batch)
+				default:
+					drained = true
+				}
+			}
+			next := m.Next()
+			reply <- m
+			m = next
+		}
+	}
+}
+
+func (m AggregateMap) addEvents(events []Event) {
+	for i := range events {
+		m.AddEvent(&events[i])
+	}
+}
+
+// An aggregate map split into shards that are reduced in parallel
+// Events are distributed by the hash of their name, so all series of a name are in the
+// same shard and merging the shards does not need to merge aggregates
+// AddEvent and Flush must be called from a single goroutine
+type ShardedMap struct {
+	shards []*shard
+	// Events not yet sent to each shard
+	batches [][]Event
+}
+
+func NewShardedMap(shards int) *ShardedMap {
+	if shards < 1 {
+		shards = 1
+	}
+	s := &ShardedMap{make([]*shard, shards), make([][]Event, shards)}
+	for i := range s.shards {
+		s.shards[i] = &shard{make(chan []Event, shardBuffer), make(chan chan AggregateMap)}
+		s.batches[i] = make([]Event, 0, shardBatch)
+		go s.shards[i].run()
+	}
+	return s
+}
+
+func (s *ShardedMap) AddEvent(event *Event) {
+	i := hashString(event.Name) % uint64(len(s.shards))
+	s.batches[i] = append(s.batches[i], *event)
+	if len(s.batches[i]) == shardBatch {
+		s.send(int(i))
+	}
+}
+
+// Send the pending events of a shard, the batch is owned by the shard afterwards
+func (s *ShardedMap) send(i int) {
+	s.shards[i].events <- s.batches[i]
+	s.batches[i] = make([]Event, 0, shardBatch)
+}
+
+// Get the merged aggregates of all shards and start a new interval
+func (s *ShardedMap) Flush() AggregateMap {
+	m := make(AggregateMap)
+	reply := make(chan AggregateMap)
+	for i, shard := range s.shards {
+		if len(s.batches[i]) > 0 {
+			s.send(i)
+		}
+		shard.flush <- reply
+		for key, aggregates := range <-reply {
+			m[key] = aggregates
+		}
+	}
+	return m
+}
+
+// Like Aggregator, but reduces events in the given number of shards in parallel
+func ShardedAggregator(eventChan chan Event, backend Backend, interval int, shards int, quit chan chan bool) {
+	aggregate(NewShardedMap(shards), eventChan, backend, interval, quit)
+}
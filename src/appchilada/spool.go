@@ -0,0 +1,326 @@
+package appchilada
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"json"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Size of the record header, the payload length and its CRC-32 checksum
+const spoolHeaderSize = 8
+
+// Returned for records with a wrong checksum or length, as opposed to errors reading the file
+var errSpoolCorrupt = os.NewError("corrupt spool record")
+
+var errSpoolNotOpen = os.NewError("spool is not open")
+
+// Aggregates of a spooled aggregation, like the record stored in CouchDB
+type spoolRecord struct {
+	Time    int64
+	Counts  map[string]*Count
+	Timings map[string]*Timing
+	Gauges  map[string]*Gauge
+	Sets    map[string]*Set
+}
+
+// A backend that appends aggregations to a file before storing them in another backend
+// Aggregations are stored in order from the file, failed stores are retried with exponential
+// backoff. The offset of the first aggregation that was not stored is kept in a second file,
+// so aggregations that were not stored before a restart are replayed without duplicating the
+// others. An aggregation is only stored twice if the server crashes between storing it and
+// writing the offset
+type SpoolBackend struct {
+	Backend
+	// Path of the spool file, the offset is kept in Path + ".offset"
+	Path   string
+	mutex  sync.Mutex
+	file   *os.File
+	reader *os.File
+	// End of the spool file
+	size int64
+	// Start of the first aggregation that was not stored
+	offset int64
+	// Signals the worker that an aggregation was appended
+	wake chan bool
+	// Closed to stop the worker
+	quit chan bool
+	// Closed when the worker stopped
+	done chan bool
+}
+
+func NewSpoolBackend(backend Backend, path string) *SpoolBackend {
+	return &SpoolBackend{Backend: backend, Path: path}
+}
+
+// Open the spool file and start storing its aggregations once the backend could be opened
+func (s *SpoolBackend) Open() os.Error {
+	// Stores fail until the spool is open
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	file, err := os.OpenFile(s.Path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	reader, err := os.Open(s.Path)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.reader = file, reader
+	if err := s.recover(); err != nil {
+		file.Close()
+		reader.Close()
+		s.file, s.reader = nil, nil
+		return err
+	}
+	if s.offset < s.size {
+		log.Printf("Replaying %d bytes of spooled aggregations from %s", s.size-s.offset, s.Path)
+	}
+	s.wake = make(chan bool, 1)
+	s.quit = make(chan bool)
+	s.done = make(chan bool)
+	go s.run()
+	return nil
+}
+
+// Read the offset and truncate a partially written or corrupt record at the end of the file
+// Corrupt records before the end are skipped when they are read
+func (s *SpoolBackend) recover() os.Error {
+	size, err := s.file.Seek(0, 2)
+	if err != nil {
+		return err
+	}
+	s.size = size
+	if data, err := ioutil.ReadFile(s.offsetPath()); err == nil {
+		if s.offset, err = strconv.Atoi64(string(data)); err != nil {
+			return fmt.Errorf("invalid spool offset in %s: %v", s.offsetPath(), err)
+		}
+	}
+	if s.offset > s.size {
+		// The file was truncated before the offset could be written
+		s.offset = 0
+	}
+	for end := s.offset; end < s.size; {
+		_, next, err := s.read(end, s.size)
+		if err == errSpoolCorrupt {
+			next = s.resync(end, s.size)
+			if next == s.size {
+				log.Printf("Truncating spool %s at %d: %v", s.Path, end, err)
+				s.size = end
+				return s.file.Truncate(end)
+			}
+		} else if err != nil {
+			return err
+		}
+		end = next
+	}
+	return nil
+}
+
+// Find the next record after a corrupt record at offset, returns size if there is none
+func (s *SpoolBackend) resync(offset int64, size int64) int64 {
+	next := offset + 1
+	for ; next < size; next++ {
+		if _, _, err := s.read(next, size); err != errSpoolCorrupt {
+			break
+		}
+	}
+	return next
+}
+
+func (s *SpoolBackend) offsetPath() string {
+	return s.Path + ".offset"
+}
+
+// Append an aggregation to the spool file, it is stored in the backend in the background
+func (s *SpoolBackend) Store(m AggregateMap, t *time.Time) os.Error {
+	payload, err := json.Marshal(&spoolRecord{t.Seconds(), m.Counts(), m.Timings(), m.Gauges(), m.Sets()})
+	if err != nil {
+		return err
+	}
+	record := make([]byte, spoolHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[spoolHeaderSize:], payload)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return errSpoolNotOpen
+	}
+	if _, err := s.file.Write(record); err != nil {
+		// Remove a partially written record
+		s.file.Truncate(s.size)
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.size += int64(len(record))
+	select {
+	case s.wake <- true:
+	default:
+	}
+	return nil
+}
+
+// Stop storing aggregations and close the backend, aggregations that were not stored
+// are replayed when the spool is opened again
+func (s *SpoolBackend) Close() os.Error {
+	if s.quit == nil {
+		// The spool file could not be opened
+		return s.Backend.Close()
+	}
+	close(s.quit)
+	<-s.done
+	s.mutex.Lock()
+	s.file.Close()
+	s.reader.Close()
+	s.file, s.reader, s.quit = nil, nil, nil
+	s.mutex.Unlock()
+	return s.Backend.Close()
+}
+
+func (s *SpoolBackend) run() {
+	defer close(s.done)
+	delay := RetryDelay
+	for {
+		err := s.Backend.Open()
+		if err == nil {
+			break
+		}
+		log.Printf("Error opening backend, retrying in %d seconds: %s", delay, err)
+		if !s.wait(delay) {
+			return
+		}
+		delay = nextRetryDelay(delay)
+	}
+	delay = RetryDelay
+	for {
+		m, t, next, err := s.next()
+		if err == errSpoolCorrupt {
+			// Continue with the record after the corrupt record
+			if err = s.commit(next); err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			log.Printf("Error reading spool %s, retrying in %d seconds: %v", s.Path, delay, err)
+			if !s.wait(delay) {
+				return
+			}
+			delay = nextRetryDelay(delay)
+			continue
+		}
+		if m == nil {
+			return
+		}
+		if err := s.Backend.Store(m, t); err != nil {
+			log.Printf("Error storing spooled aggregation, retrying in %d seconds: %s", delay, err)
+			if !s.wait(delay) {
+				return
+			}
+			delay = nextRetryDelay(delay)
+			continue
+		}
+		delay = RetryDelay
+		if err := s.commit(next); err != nil {
+			log.Printf("Error writing spool offset: %v", err)
+		}
+	}
+}
+
+// Wait the given seconds, returns false if the spool was closed
+func (s *SpoolBackend) wait(delay int64) bool {
+	select {
+	case <-time.After(delay * seconds):
+		return true
+	case <-s.quit:
+	}
+	return false
+}
+
+// Get the first aggregation that was not stored and the offset after it, waiting until there is one
+// Returns a nil map if the spool was closed. If the record is corrupt errSpoolCorrupt is returned
+// with the offset of the next record
+func (s *SpoolBackend) next() (AggregateMap, *time.Time, int64, os.Error) {
+	for {
+		s.mutex.Lock()
+		offset, size := s.offset, s.size
+		s.mutex.Unlock()
+		if offset < size {
+			record, next, err := s.read(offset, size)
+			if err == errSpoolCorrupt {
+				next = s.resync(offset, size)
+				log.Printf("Skipping %d bytes of corrupt aggregations at %d in spool %s", next-offset, offset, s.Path)
+				return nil, nil, next, err
+			}
+			if err != nil {
+				return nil, nil, 0, err
+			}
+			return record.aggregateMap(), time.SecondsToLocalTime(record.Time), next, nil
+		}
+		select {
+		case <-s.wake:
+		case <-s.quit:
+			return nil, nil, 0, nil
+		}
+	}
+	panic("unreachable")
+}
+
+// Read the record at offset and verify that it ends before size and its checksum
+func (s *SpoolBackend) read(offset int64, size int64) (*spoolRecord, int64, os.Error) {
+	if offset+spoolHeaderSize > size {
+		return nil, 0, errSpoolCorrupt
+	}
+	header := make([]byte, spoolHeaderSize)
+	if _, err := s.reader.ReadAt(header, offset); err != nil {
+		return nil, 0, err
+	}
+	next := offset + spoolHeaderSize + int64(binary.BigEndian.Uint32(header[0:4]))
+	if next > size {
+		return nil, 0, errSpoolCorrupt
+	}
+	payload := make([]byte, next-offset-spoolHeaderSize)
+	if _, err := s.reader.ReadAt(payload, offset+spoolHeaderSize); err != nil {
+		return nil, 0, err
+	}
+	record := &spoolRecord{}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) || json.Unmarshal(payload, record) != nil {
+		return nil, 0, errSpoolCorrupt
+	}
+	return record, next, nil
+}
+
+// Remember that all aggregations before offset were stored, the file is emptied when all were stored
+func (s *SpoolBackend) commit(offset int64) os.Error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if offset == s.size {
+		if err := s.file.Truncate(0); err != nil {
+			return err
+		}
+		s.size = 0
+		offset = 0
+	}
+	s.offset = offset
+	// Replace the offset file atomically, a partially written offset would replay or skip aggregations
+	temp := s.offsetPath() + ".tmp"
+	if err := ioutil.WriteFile(temp, []byte(strconv.Itoa64(offset)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, s.offsetPath())
+}
+
+// Restore the aggregates of a record, sets only keep their cardinality
+func (record *spoolRecord) aggregateMap() AggregateMap {
+	return restoreAggregates(record.Counts, record.Timings, record.Gauges, record.Sets)
+}
@@ -0,0 +1,52 @@
+package appchilada
+
+import (
+	"sort"
+	"strings"
+)
+
+// Separators of tags in a series key
+const (
+	tagSeparator      = ";"
+	tagValueSeparator = "="
+)
+
+// Replace separators in tag keys and values
+func escapeTag(s string) string {
+	s = strings.Replace(s, tagSeparator, "_", -1)
+	return strings.Replace(s, tagValueSeparator, "_", -1)
+}
+
+// Get the key of a series with tags in the form name;key1=value1;key2=value2
+// Tags are sorted by key, so the same tag set always results in the same key
+func SeriesKey(name string, tags map[string]string) string {
+	name = strings.Replace(name, tagSeparator, "_", -1)
+	if len(tags) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(tags)+1)
+	parts = append(parts, name)
+	for _, key := range keys {
+		parts = append(parts, escapeTag(key)+tagValueSeparator+escapeTag(tags[key]))
+	}
+	return strings.Join(parts, tagSeparator)
+}
+
+// Get the name and tags from a series key
+func ParseSeriesKey(key string) (name string, tags map[string]string) {
+	parts := strings.Split(key, tagSeparator)
+	tags = make(map[string]string, len(parts)-1)
+	for _, part := range parts[1:] {
+		if i := strings.Index(part, tagValueSeparator); i >= 0 {
+			tags[part[:i]] = part[i+1:]
+		} else {
+			tags[part] = ""
+		}
+	}
+	return parts[0], tags
+}
@@ -0,0 +1,27 @@
+package appchilada
+
+import (
+	"time"
+)
+
+// Get the start of the interval containing the Unix time t
+func IntervalStart(t int64, interval int) int64 {
+	return t - t%int64(interval)
+}
+
+// Like time.Tick, but ticks are aligned to multiples of interval seconds since the epoch,
+// so the intervals of different servers line up
+// Every tick sends the end of the interval as Unix time
+func AlignedTick(interval int) <-chan int64 {
+	c := make(chan int64)
+	go func() {
+		length := int64(interval) * seconds
+		for {
+			now := time.Nanoseconds()
+			next := (now/length + 1) * length
+			time.Sleep(next - now)
+			c <- next / seconds
+		}
+	}()
+	return c
+}
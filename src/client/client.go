@@ -30,10 +30,13 @@ func main() {
 	for {
 		label := randomLabels[rand.Intn(len(randomLabels))]
 		var message string
-		if rand.Intn(2) < 1 {
+		switch rand.Intn(3) {
+		case 0:
 			message = `{"type":` + strconv.Itoa(appchilada.EventTypeCount) + `,"name":"` + label + `","value":` + strconv.Itoa(rand.Intn(5) + 1) + `}`
-		} else {
+		case 1:
 			message = `{"type":` + strconv.Itoa(appchilada.EventTypeTiming) + `,"name":"` + label + `","value":` + strconv.Itoa(rand.Intn(1000) + 10) + `}`
+		default:
+			message = `{"type":` + strconv.Itoa(appchilada.EventTypeGauge) + `,"name":"` + label + `","value":` + strconv.Itoa(rand.Intn(100)) + `}`
 		}
 		println(message)
 		if _, err := socket.Write([]byte(message)); err != nil {
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"json"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Server configuration file, every value sets the flag of the same meaning
+// Flags given on the command line take precedence over the file
+type config struct {
+	// Flush interval in seconds
+	Interval *int `json:"interval"`
+	// Days records are kept in the backends, 0 keeps them forever
+	Retention *int            `json:"retention"`
+	Listeners listenersConfig `json:"listeners"`
+	Backends  []backendConfig `json:"backends"`
+	// Path prefix of the files aggregations are spooled to until they are stored, one per backend
+	Spool    *string        `json:"spool"`
+	Frontend frontendConfig `json:"frontend"`
+}
+
+type listenersConfig struct {
+	Udp      *listenerConfig `json:"udp"`
+	Tcp      *listenerConfig `json:"tcp"`
+	Graphite *listenerConfig `json:"graphite"`
+	Influx   *listenerConfig `json:"influx"`
+	// Paths of Unix sockets
+	Unix       *string `json:"unix"`
+	Unixgram   *string `json:"unixgram"`
+	SocketMode *string `json:"socketMode"`
+}
+
+type listenerConfig struct {
+	Address *string `json:"address"`
+	Port    *int    `json:"port"`
+	// Pattern of Graphite paths that are counts
+	Counts *string `json:"counts"`
+}
+
+type backendConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Database string `json:"database"`
+}
+
+type frontendConfig struct {
+	Address     *string `json:"address"`
+	Development *bool   `json:"development"`
+}
+
+// Keys allowed in the objects of the file by their path, to report misspelled keys
+// The elements of an array have the path of the array
+var configKeys = map[string][]string{
+	"":                   {"interval", "retention", "listeners", "backends", "spool", "frontend"},
+	"listeners":          {"udp", "tcp", "graphite", "influx", "unix", "unixgram", "socketMode"},
+	"listeners.udp":      {"address", "port"},
+	"listeners.tcp":      {"address", "port"},
+	"listeners.graphite": {"address", "port", "counts"},
+	"listeners.influx":   {"address", "port"},
+	"backends":           {"host", "port", "database"},
+	"frontend":           {"address", "development"},
+}
+
+// Names of the flags that can be set by the file
+var configFlags = []string{
+	"interval", "retention",
+	"address", "port", "tcp-address", "tcp-port", "graphite-address", "graphite-port", "graphite-counts",
+	"influx-address", "influx-port", "unix-socket", "unixgram-socket", "socket-mode",
+	"couchdb", "spool", "frontend-address", "development",
+}
+
+// Get the flag values set by the config file by flag name
+func (c *config) flagValues() map[string]string {
+	values := make(map[string]string)
+	setInt := func(name string, value *int) {
+		if value != nil {
+			values[name] = strconv.Itoa(*value)
+		}
+	}
+	setString := func(name string, value *string) {
+		if value != nil {
+			values[name] = *value
+		}
+	}
+	setListener := func(prefix string, listener *listenerConfig) {
+		if listener != nil {
+			setString(prefix+"address", listener.Address)
+			setInt(prefix+"port", listener.Port)
+		}
+	}
+	setInt("interval", c.Interval)
+	setInt("retention", c.Retention)
+	setListener("", c.Listeners.Udp)
+	setListener("tcp-", c.Listeners.Tcp)
+	setListener("graphite-", c.Listeners.Graphite)
+	setListener("influx-", c.Listeners.Influx)
+	if c.Listeners.Graphite != nil {
+		setString("graphite-counts", c.Listeners.Graphite.Counts)
+	}
+	setString("unix-socket", c.Listeners.Unix)
+	setString("unixgram-socket", c.Listeners.Unixgram)
+	setString("socket-mode", c.Listeners.SocketMode)
+	if len(c.Backends) > 0 {
+		specs := make([]string, len(c.Backends))
+		for i, backend := range c.Backends {
+			specs[i] = fmt.Sprintf("%s:%d/%s", backend.Host, backend.Port, backend.Database)
+		}
+		values["couchdb"] = strings.Join(specs, ",")
+	}
+	setString("spool", c.Spool)
+	setString("frontend-address", c.Frontend.Address)
+	if c.Frontend.Development != nil {
+		values["development"] = strconv.Btoa(*c.Frontend.Development)
+	}
+	return values
+}
+
+// Get the names of the flags given on the command line
+func commandLineFlags() map[string]bool {
+	names := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		names[f.Name] = true
+	})
+	return names
+}
+
+// Read a config file and set its flags that were not given on the command line
+// Flags that are not in the file are reset to their default
+func loadConfig(path string, commandLine map[string]bool) os.Error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var keys map[string]interface{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("invalid JSON in %s: %v", path, err)
+	}
+	if err := checkConfigKeys("", keys); err != nil {
+		return fmt.Errorf("%v in %s", err, path)
+	}
+	c := &config{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("invalid value in %s: %v", path, err)
+	}
+	values := c.flagValues()
+	var invalid []string
+	for _, name := range configFlags {
+		if commandLine[name] {
+			continue
+		}
+		value, ok := values[name]
+		if !ok {
+			value = flag.Lookup(name).DefValue
+		}
+		if !flag.Set(name, value) {
+			invalid = append(invalid, fmt.Sprintf("%s=%q", name, value))
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("invalid values in %s: %s", path, strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+// Check that the objects in a decoded config value only have the keys allowed at their path
+// Values of the wrong type are left to the decoding into the config
+func checkConfigKeys(path string, value interface{}) os.Error {
+	switch value := value.(type) {
+	case []interface{}:
+		for _, element := range value {
+			if err := checkConfigKeys(path, element); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		allowed, ok := configKeys[path]
+		if !ok {
+			return nil
+		}
+		// Report the first unknown key in a stable order
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			name := key
+			if path != "" {
+				name = path + "." + key
+			}
+			if !containsString(allowed, key) {
+				return fmt.Errorf("unknown key %q, expected one of %s", name, strings.Join(allowed, ", "))
+			}
+			if err := checkConfigKeys(name, value[key]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the values of all flags, returns an error for every invalid value sorted by flag name
+func validateFlags() (errs []os.Error) {
+	messages := make(map[string][]string)
+	invalid := func(name string, format string, args ...interface{}) {
+		messages[name] = append(messages[name], fmt.Sprintf(format, args...))
+	}
+	ports := map[string]int{"port": *port, "tcp-port": *tcpPort, "graphite-port": *graphitePort, "influx-port": *influxPort}
+	for name, value := range ports {
+		if value < 0 || value > 65535 || (value == 0 && name == "port") {
+			invalid(name, "port %d out of range", value)
+		}
+	}
+	if *interval < 1 {
+		invalid("interval", "must be at least 1 second, got %d", *interval)
+	}
+	if *retention < 0 {
+		invalid("retention", "must not be negative, got %d", *retention)
+	}
+	if *lateness < 0 {
+		invalid("lateness", "must not be negative, got %d", *lateness)
+	}
+	if *shards < 1 {
+		invalid("shards", "must be at least 1, got %d", *shards)
+	}
+	if *shutdownTimeout < 1 {
+		invalid("shutdown-timeout", "must be at least 1 second, got %d", *shutdownTimeout)
+	}
+	if *retryQueue < 1 {
+		invalid("retry-queue", "must be at least 1, got %d", *retryQueue)
+	}
+	if *retryMaxDelay < 1 {
+		invalid("retry-max-delay", "must be at least 1 second, got %d", *retryMaxDelay)
+	}
+	if *setThreshold < 1 {
+		invalid("set-threshold", "must be at least 1, got %d", *setThreshold)
+	}
+	if _, err := parsePercentiles(*percentiles); err != nil {
+		invalid("percentiles", "%v", err)
+	}
+	if _, err := strconv.Btoui64(*socketMode, 8); err != nil {
+		invalid("socket-mode", "%q is not an octal file mode", *socketMode)
+	}
+	if _, err := regexp.Compile(*graphiteCounts); err != nil {
+		invalid("graphite-counts", "%v", err)
+	}
+	for _, spec := range strings.Split(*couchDbs, ",") {
+		if _, err := parseCouchDb(strings.TrimSpace(spec)); err != nil {
+			invalid("couchdb", "%v", err)
+		}
+	}
+	if *frontendAddress == "" {
+		invalid("frontend-address", "must not be empty")
+	}
+	names := make([]string, 0, len(messages))
+	for name := range messages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, message := range messages[name] {
+			errs = append(errs, fmt.Errorf("-%s: %s", name, message))
+		}
+	}
+	return
+}
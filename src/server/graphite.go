@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+	"appchilada"
+)
+
+func initializeGraphiteListener(address string, port int) (*net.TCPListener, os.Error) {
+	ip := net.ParseIP(address)
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{
+		IP:   ip,
+		Port: port,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error opening Graphite listener: %v", err)
+	}
+	log.Printf("Starting Graphite listener on tcp://%s:%d", ip.String(), port)
+	return listener, nil
+}
+
+// Accept Graphite connections and send the parsed points to the channel
+// Names matching countPattern are treated as counts, all other names as gauges
+func graphiteLoop(pointChan chan *point, listener net.Listener, countPattern *regexp.Regexp) {
+	acceptLines(listener, "Graphite", func(line []byte) {
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			if p, err := parseGraphiteLine(line, countPattern); err != nil {
+				log.Printf("Graphite parse error: %v", err)
+			} else {
+				pointChan <- p
+			}
+		}
+	})
+}
+
+// Parse a Graphite plaintext line of the form <path> <value> <timestamp>
+func parseGraphiteLine(line []byte, countPattern *regexp.Regexp) (*point, os.Error) {
+	fields := bytes.Fields(line)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid Graphite line %q: expected path, value and timestamp", line)
+	}
+	value, err := strconv.Atof64(string(fields[1]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Graphite line %q: %v", line, err)
+	}
+	timestamp, err := strconv.Atof64(string(fields[2]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Graphite line %q: %v", line, err)
+	}
+	event := &appchilada.Event{
+		Type:  appchilada.EventTypeGauge,
+		Name:  string(fields[0]),
+		Value: int64(math.Floor(value + 0.5)),
+	}
+	if countPattern != nil && countPattern.Match(fields[0]) {
+		event.Type = appchilada.EventTypeCount
+	}
+	p := &point{int64(timestamp), event}
+	if p.timestamp <= 0 {
+		// Graphite clients use -1 for the current time
+		p.timestamp = time.Seconds()
+	}
+	return p, nil
+}
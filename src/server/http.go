@@ -0,0 +1,121 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"http"
+	"io"
+	"io/ioutil"
+	"json"
+	"log"
+	"os"
+	"appchilada"
+)
+
+// Maximum size of a request body (after decompression)
+const maxRequestSize = 10 << 20
+
+var errRequestTooLarge = fmt.Errorf("Request body larger than %d bytes", maxRequestSize)
+
+type eventsResponse struct {
+	Accepted int      `json:"accepted"`
+	Rejected int      `json:"rejected"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// Handle POST requests with a JSON array of events (optionally gzip encoded) and send the events to the channel
+func eventsHandler(eventChan chan appchilada.Event) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		message, err := readBody(r)
+		if err != nil {
+			bodyError(w, err)
+			return
+		}
+		events, errs := parseJsonMessage(message)
+		for _, event := range events {
+			eventChan <- *event
+		}
+		response := &eventsResponse{Accepted: len(events), Rejected: len(errs)}
+		for _, err := range errs {
+			response.Errors = append(response.Errors, err.String())
+		}
+		status := http.StatusAccepted
+		if len(events) == 0 && len(errs) > 0 {
+			status = http.StatusBadRequest
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("Error encoding response: %v", err)
+		}
+	}
+}
+
+// Counters of data the server dropped or did not store yet
+type statusResponse struct {
+	LateEventsRejected int64 `json:"lateEventsRejected"`
+	// Aggregations waiting in the retry queues of all backends
+	RetryQueueDepth int `json:"retryQueueDepth"`
+	// Aggregations dropped from full retry queues since the backends were opened
+	RetryDropped int64 `json:"retryDropped"`
+}
+
+// Handle GET requests with the counters of the server as JSON
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	response := &statusResponse{LateEventsRejected: appchilada.LateEventsRejected()}
+	response.addRetryStatus(backend.current())
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// Add the counters of the retry backends of a backend
+func (response *statusResponse) addRetryStatus(b appchilada.Backend) {
+	switch b := b.(type) {
+	case *appchilada.MultiBackend:
+		for _, member := range b.Backends {
+			response.addRetryStatus(member)
+		}
+	case *appchilada.RetryBackend:
+		response.RetryQueueDepth += b.QueueDepth()
+		response.RetryDropped += b.Dropped()
+	}
+}
+
+// Read the body of a request, decompressing it if it is gzip encoded
+// Bodies larger than maxRequestSize return errRequestTooLarge
+func readBody(r *http.Request) ([]byte, os.Error) {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid gzip body: %v", err)
+		}
+		defer reader.Close()
+		body = reader
+	}
+	// Read one more byte to tell a body of the maximum size from a larger one
+	message, err := ioutil.ReadAll(io.LimitReader(body, maxRequestSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading body: %v", err)
+	}
+	if len(message) > maxRequestSize {
+		return nil, errRequestTooLarge
+	}
+	return message, nil
+}
+
+// Respond with the error of reading or decoding a request body
+func bodyError(w http.ResponseWriter, err os.Error) {
+	status := http.StatusBadRequest
+	if err == errRequestTooLarge {
+		status = http.StatusRequestEntityTooLarge
+	}
+	http.Error(w, err.String(), status)
+}
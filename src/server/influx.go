@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"http"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"appchilada"
+)
+
+// Nanoseconds per timestamp unit by the precision query parameter of /write requests
+var influxPrecisions = map[string]int64{
+	"":   1,
+	"n":  1,
+	"ns": 1,
+	"u":  1e3,
+	"us": 1e3,
+	"ms": 1e6,
+	"s":  1e9,
+	"m":  60e9,
+	"h":  3600e9,
+}
+
+// Parse InfluxDB line protocol messages with one or more newline separated lines
+// Every numeric or boolean field becomes a gauge named <measurement>.<field> with the tags
+// and timestamp of the line, string fields are ignored
+func parseInfluxMessage(message []byte) ([]*appchilada.Event, []os.Error) {
+	return parseInfluxLines(message, 1)
+}
+
+// Parse line protocol lines with timestamps in units of the given nanoseconds
+func parseInfluxLines(message []byte, unit int64) (events []*appchilada.Event, errs []os.Error) {
+	for _, line := range bytes.Split(message, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		lineEvents, err := parseInfluxLine(line, unit)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			events = append(events, lineEvents...)
+		}
+	}
+	return
+}
+
+// Parse a line of the form <measurement>[,<tag>=<value>...] <field>=<value>[,<field>=<value>...] [<timestamp>]
+func parseInfluxLine(line []byte, unit int64) ([]*appchilada.Event, os.Error) {
+	parts := splitInflux(line, ' ')
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("invalid InfluxDB line %q: expected measurement, fields and timestamp", line)
+	}
+	key := splitInflux(parts[0], ',')
+	measurement := unescapeInflux(key[0])
+	if measurement == "" {
+		return nil, fmt.Errorf("invalid InfluxDB line %q: missing measurement", line)
+	}
+	var tags map[string]string
+	if len(key) > 1 {
+		tags = make(map[string]string, len(key)-1)
+		for _, tag := range key[1:] {
+			pair := splitInflux(tag, '=')
+			if len(pair) != 2 {
+				return nil, fmt.Errorf("invalid InfluxDB line %q: invalid tag %q", line, tag)
+			}
+			tags[unescapeInflux(pair[0])] = unescapeInflux(pair[1])
+		}
+	}
+	var timestamp int64
+	if len(parts) == 3 {
+		value, err := strconv.Atoi64(string(parts[2]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid InfluxDB line %q: invalid timestamp: %v", line, err)
+		}
+		// Divide or multiply without converting to nanoseconds, which could overflow
+		if unit < 1e9 {
+			timestamp = value / (1e9 / unit)
+		} else {
+			timestamp = value * (unit / 1e9)
+		}
+	}
+	fields := splitInflux(parts[1], ',')
+	events := make([]*appchilada.Event, 0, len(fields))
+	for _, field := range fields {
+		pair := splitInflux(field, '=')
+		if len(pair) != 2 || len(pair[1]) == 0 {
+			return nil, fmt.Errorf("invalid InfluxDB line %q: invalid field %q", line, field)
+		}
+		value, ok, err := parseInfluxValue(pair[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid InfluxDB line %q: %v", line, err)
+		}
+		if !ok {
+			continue
+		}
+		events = append(events, &appchilada.Event{
+			Type:  appchilada.EventTypeGauge,
+			Name:  measurement + "." + unescapeInflux(pair[0]),
+			Value: value,
+			Tags:  tags,
+			Time:  timestamp,
+		})
+	}
+	return events, nil
+}
+
+// Parse a field value, ok is false for values that cannot be stored (strings)
+func parseInfluxValue(value []byte) (result int64, ok bool, err os.Error) {
+	switch s := string(value); {
+	case s[0] == '"':
+		return 0, false, nil
+	case s == "t" || s == "T" || s == "true" || s == "True" || s == "TRUE":
+		return 1, true, nil
+	case s == "f" || s == "F" || s == "false" || s == "False" || s == "FALSE":
+		return 0, true, nil
+	case strings.HasSuffix(s, "i") || strings.HasSuffix(s, "u"):
+		result, err = strconv.Atoi64(s[:len(s)-1])
+		return result, err == nil, err
+	default:
+		f, err := strconv.Atof64(s)
+		return int64(math.Floor(f + 0.5)), err == nil, err
+	}
+	return
+}
+
+// Split at separators that are not escaped with a backslash or inside double quotes
+func splitInflux(s []byte, sep byte) [][]byte {
+	var parts [][]byte
+	start := 0
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Remove backslashes of escaped characters
+func unescapeInflux(s []byte) string {
+	if bytes.IndexByte(s, '\\') < 0 {
+		return string(s)
+	}
+	result := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		result = append(result, s[i])
+	}
+	return string(result)
+}
+
+// Handle InfluxDB /write requests with line protocol bodies (optionally gzip encoded)
+// Timestamps are in nanoseconds unless the precision parameter is n, u, ms, s, m or h
+func influxWriteHandler(eventChan chan appchilada.Event) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// The body is not a form, so only the URL is parsed
+		query, err := http.ParseQuery(r.URL.RawQuery)
+		if err != nil {
+			http.Error(w, err.String(), http.StatusBadRequest)
+			return
+		}
+		unit, ok := influxPrecisions[query.Get("precision")]
+		if !ok {
+			http.Error(w, fmt.Sprintf("invalid precision %q", query.Get("precision")), http.StatusBadRequest)
+			return
+		}
+		message, err := readBody(r)
+		if err != nil {
+			bodyError(w, err)
+			return
+		}
+		events, errs := parseInfluxLines(message, unit)
+		for _, event := range events {
+			eventChan <- *event
+		}
+		if len(errs) > 0 {
+			// Valid lines are kept, like InfluxDB does for partial writes
+			http.Error(w, fmt.Sprintf("partial write: %d lines rejected, first error: %v", len(errs), errs[0]), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"json"
+	"os"
+	"appchilada"
+)
+
+// Parse a JSON message with a single event, an array of events or newline delimited events
+// Items that could not be decoded are skipped and returned as errors
+func parseJsonMessage(message []byte) (events []*appchilada.Event, errs []os.Error) {
+	message = bytes.TrimSpace(message)
+	if len(message) > 0 && message[0] == '[' {
+		var items []json.RawMessage
+		if err := json.Unmarshal(message, &items); err != nil {
+			return nil, []os.Error{fmt.Errorf("JSON decode error: %v", err)}
+		}
+		for i, item := range items {
+			event := new(appchilada.Event)
+			if err := json.Unmarshal(item, event); err != nil {
+				errs = append(errs, fmt.Errorf("JSON decode error in item %d: %v", i, err))
+			} else {
+				events = append(events, event)
+			}
+		}
+		return
+	}
+	// A single event could span multiple lines
+	event := new(appchilada.Event)
+	if err := json.Unmarshal(message, event); err == nil {
+		return []*appchilada.Event{event}, nil
+	}
+	for i, line := range bytes.Split(message, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		event := new(appchilada.Event)
+		if err := json.Unmarshal(line, event); err != nil {
+			errs = append(errs, fmt.Errorf("JSON decode error in line %d: %v", i+1, err))
+		} else {
+			events = append(events, event)
+		}
+	}
+	return
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"container/list"
+	"http"
+	"io"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"appchilada"
+)
+
+// Names of all listeners in the order they are started
+var listenerNames = []string{"udp", "tcp", "unix", "unixgram", "graphite", "influx", "frontend"}
+
+// Flags of every listener, a listener is restarted when one of its flags changes
+var listenerFlags = map[string][]string{
+	"udp":      {"address", "port"},
+	"tcp":      {"tcp-address", "tcp-port"},
+	"unix":     {"unix-socket", "socket-mode"},
+	"unixgram": {"unixgram-socket", "socket-mode"},
+	"graphite": {"graphite-address", "graphite-port", "graphite-counts"},
+	"influx":   {"influx-address", "influx-port"},
+	"frontend": {"frontend-address"},
+}
+
+// Running listeners by name, stopped listeners are nil
+var listeners = make(map[string]io.Closer)
+
+// Listeners that were closed, their loops stop on the next error and forget them
+var closedListeners = make(map[io.Closer]bool)
+var closedMutex sync.Mutex
+
+// Open connections of the stream listeners and running HTTP handlers, closed and waited for on shutdown
+var connections = newConnectionTracker()
+
+type connectionTracker struct {
+	mutex sync.Mutex
+	conns *list.List
+	// Connection handlers and HTTP handlers that are running
+	handlers sync.WaitGroup
+	closing  bool
+}
+
+func newConnectionTracker() *connectionTracker {
+	return &connectionTracker{conns: list.New()}
+}
+
+// Track an accepted connection until remove is called with the returned element
+// Returns nil and closes the connection if the server is shutting down
+func (c *connectionTracker) add(conn io.Closer) *list.Element {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closing {
+		conn.Close()
+		return nil
+	}
+	c.handlers.Add(1)
+	return c.conns.PushBack(conn)
+}
+
+// Stop tracking a connection after its handler returned
+func (c *connectionTracker) remove(e *list.Element) {
+	c.mutex.Lock()
+	c.conns.Remove(e)
+	c.mutex.Unlock()
+	c.handlers.Done()
+}
+
+// Track a running HTTP handler until handlerDone is called, returns false if the server is shutting down
+func (c *connectionTracker) startHandler() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closing {
+		return false
+	}
+	c.handlers.Add(1)
+	return true
+}
+
+func (c *connectionTracker) handlerDone() {
+	c.handlers.Done()
+}
+
+// Close all connections and wait until their handlers and the HTTP handlers sent their events
+func (c *connectionTracker) closeAndWait() {
+	c.mutex.Lock()
+	c.closing = true
+	for e := c.conns.Front(); e != nil; e = e.Next() {
+		e.Value.(io.Closer).Close()
+	}
+	c.mutex.Unlock()
+	c.handlers.Wait()
+}
+
+// Reject HTTP requests while shutting down and let shutdown wait for running requests
+func trackHandler(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !connections.startHandler() {
+			http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		defer connections.handlerDone()
+		handler(w, r)
+	}
+}
+
+// Start a listener by name, unless it is disabled by its flags
+// Events are sent to eventChan, pre-aggregated points to pointChan
+func startListener(name string, eventChan chan appchilada.Event, pointChan chan *point) os.Error {
+	var listener io.Closer
+	switch name {
+	case "udp":
+		socket, err := initializeSocket(*address, *port)
+		if err != nil {
+			return err
+		}
+		listener = socket
+		go eventLoop(eventChan, socket, parseMessage)
+	case "tcp":
+		if *tcpPort == 0 {
+			return nil
+		}
+		tcpListener, err := initializeTcpListener(*tcpAddress, *tcpPort)
+		if err != nil {
+			return err
+		}
+		listener = tcpListener
+		go acceptLoop(eventChan, tcpListener)
+	case "unix":
+		if *unixSocket == "" {
+			return nil
+		}
+		mode, _ := strconv.Btoui64(*socketMode, 8)
+		unixListener, err := initializeUnixListener(*unixSocket, uint32(mode))
+		if err != nil {
+			return err
+		}
+		listener = unixListener
+		go acceptLoop(eventChan, unixListener)
+	case "unixgram":
+		if *unixgramSocket == "" {
+			return nil
+		}
+		mode, _ := strconv.Btoui64(*socketMode, 8)
+		socket, err := initializeUnixgramSocket(*unixgramSocket, uint32(mode))
+		if err != nil {
+			return err
+		}
+		listener = socket
+		go eventLoop(eventChan, socket, parseMessage)
+	case "graphite":
+		if *graphitePort == 0 {
+			return nil
+		}
+		var countPattern *regexp.Regexp
+		if *graphiteCounts != "" {
+			countPattern = regexp.MustCompile(*graphiteCounts)
+		}
+		graphiteListener, err := initializeGraphiteListener(*graphiteAddress, *graphitePort)
+		if err != nil {
+			return err
+		}
+		listener = graphiteListener
+		go graphiteLoop(pointChan, graphiteListener, countPattern)
+	case "influx":
+		if *influxPort == 0 {
+			return nil
+		}
+		socket, err := initializeSocket(*influxAddress, *influxPort)
+		if err != nil {
+			return err
+		}
+		listener = socket
+		go eventLoop(eventChan, socket, parseInfluxMessage)
+	case "frontend":
+		httpListener, err := net.Listen("tcp", *frontendAddress)
+		if err != nil {
+			return err
+		}
+		listener = httpListener
+		log.Printf("Starting frontend on http://%s", httpListener.Addr())
+		go func() {
+			defer forgetListener(httpListener)
+			if err := http.Serve(httpListener, nil); err != nil && !isClosed(httpListener) {
+				log.Fatal(err)
+			}
+		}()
+	}
+	listeners[name] = listener
+	return nil
+}
+
+// Close a running listener by name
+func stopListener(name string) {
+	listener := listeners[name]
+	if listener == nil {
+		return
+	}
+	listeners[name] = nil
+	closedMutex.Lock()
+	closedListeners[listener] = true
+	closedMutex.Unlock()
+	if err := listener.Close(); err != nil {
+		log.Printf("Error closing %s listener: %v", name, err)
+	}
+}
+
+// Check if a listener was closed, errors of its loop are expected then
+func isClosed(listener io.Closer) bool {
+	closedMutex.Lock()
+	defer closedMutex.Unlock()
+	return closedListeners[listener]
+}
+
+// Forget a closed listener when its loop stopped
+func forgetListener(listener io.Closer) {
+	closedMutex.Lock()
+	defer closedMutex.Unlock()
+	remaining := make(map[io.Closer]bool, len(closedListeners))
+	for closed := range closedListeners {
+		if closed != listener {
+			remaining[closed] = true
+		}
+	}
+	closedListeners = remaining
+}
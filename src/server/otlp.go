@@ -0,0 +1,612 @@
+package main
+
+import (
+	"fmt"
+	"http"
+	"json"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"appchilada"
+)
+
+// Aggregation temporality of OTLP sums and histograms
+const (
+	otlpTemporalityDelta      = 1
+	otlpTemporalityCumulative = 2
+)
+
+// An OTLP ExportMetricsServiceRequest, field names follow the OTLP/JSON encoding
+// Integer values are encoded as strings in OTLP/JSON, so they are kept as interface{}
+type otlpMetricsRequest struct {
+	ResourceMetrics []*otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource        `json:"resource"`
+	ScopeMetrics []*otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []*otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue interface{} `json:"stringValue"`
+	BoolValue   interface{} `json:"boolValue"`
+	IntValue    interface{} `json:"intValue"`
+	DoubleValue interface{} `json:"doubleValue"`
+}
+
+type otlpMetric struct {
+	Name      string         `json:"name"`
+	Unit      string         `json:"unit"`
+	Gauge     *otlpNumbers   `json:"gauge"`
+	Sum       *otlpNumbers   `json:"sum"`
+	Histogram *otlpHistogram `json:"histogram"`
+}
+
+type otlpNumbers struct {
+	DataPoints             []*otlpNumberPoint `json:"dataPoints"`
+	AggregationTemporality int                `json:"aggregationTemporality"`
+	IsMonotonic            bool               `json:"isMonotonic"`
+}
+
+type otlpNumberPoint struct {
+	Attributes        []*otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano interface{}     `json:"startTimeUnixNano"`
+	AsDouble          interface{}     `json:"asDouble"`
+	AsInt             interface{}     `json:"asInt"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []*otlpHistogramPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+}
+
+type otlpHistogramPoint struct {
+	Attributes        []*otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano interface{}     `json:"startTimeUnixNano"`
+	BucketCounts      []interface{}   `json:"bucketCounts"`
+	ExplicitBounds    []float64       `json:"explicitBounds"`
+	Min               interface{}     `json:"min"`
+	Max               interface{}     `json:"max"`
+}
+
+// Get the value of an attribute as a tag value
+func (v *otlpAnyValue) String() string {
+	for _, value := range []interface{}{v.StringValue, v.IntValue, v.DoubleValue, v.BoolValue} {
+		if value != nil {
+			return fmt.Sprint(value)
+		}
+	}
+	return ""
+}
+
+// Convert a number that could be encoded as string, float or integer
+func otlpNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case string:
+		f, err := strconv.Atof64(v)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// Seconds the last value of a cumulative series is kept after it was last seen
+var otlpSeriesTimeout int64 = 10 * 60
+
+// The last value of a cumulative sum or histogram
+type otlpCumulative struct {
+	sum     float64
+	buckets []float64
+	bounds  []float64
+	// Start time of the cumulative values, a new start time means the series was reset
+	start float64
+	// Time the series was last seen in seconds
+	seen int64
+}
+
+// Converts OTLP metrics to events, cumulative values are converted to deltas
+// by keeping the last value of every series until it was not seen for otlpSeriesTimeout
+type otlpReceiver struct {
+	mutex       sync.Mutex
+	lastSums    map[string]*otlpCumulative
+	lastBuckets map[string]*otlpCumulative
+	// Time series were last evicted
+	evicted int64
+}
+
+func newOtlpReceiver() *otlpReceiver {
+	return &otlpReceiver{
+		lastSums:    make(map[string]*otlpCumulative),
+		lastBuckets: make(map[string]*otlpCumulative),
+		evicted:     time.Seconds(),
+	}
+}
+
+// Forget the last values of series that were not seen for otlpSeriesTimeout
+func (receiver *otlpReceiver) evict(now int64) {
+	if now-receiver.evicted < otlpSeriesTimeout {
+		return
+	}
+	receiver.evicted = now
+	for _, last := range []*map[string]*otlpCumulative{&receiver.lastSums, &receiver.lastBuckets} {
+		kept := make(map[string]*otlpCumulative, len(*last))
+		for key, cumulative := range *last {
+			if now-cumulative.seen < otlpSeriesTimeout {
+				kept[key] = cumulative
+			}
+		}
+		*last = kept
+	}
+}
+
+// Handle OTLP/HTTP metrics requests encoded as protobuf or JSON
+func (receiver *otlpReceiver) handler(eventChan chan appchilada.Event) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := readBody(r)
+		if err != nil {
+			bodyError(w, err)
+			return
+		}
+		isJson := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+		request := new(otlpMetricsRequest)
+		if isJson {
+			err = json.Unmarshal(body, request)
+		} else {
+			err = decodeOtlpMetricsRequest(body, request)
+		}
+		if err != nil {
+			http.Error(w, "Invalid OTLP request: "+err.String(), http.StatusBadRequest)
+			return
+		}
+		for _, event := range receiver.events(request) {
+			eventChan <- *event
+		}
+		// Respond with an empty ExportMetricsServiceResponse
+		if isJson {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("{}"))
+		} else {
+			w.Header().Set("Content-Type", "application/x-protobuf")
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+}
+
+// Convert the metrics of a request to events with resource and data point attributes as tags
+// Monotonic sums become counts, gauges and non-monotonic sums gauges and histograms timings
+func (receiver *otlpReceiver) events(request *otlpMetricsRequest) (events []*appchilada.Event) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.evict(time.Seconds())
+	for _, resourceMetrics := range request.ResourceMetrics {
+		for _, scopeMetrics := range resourceMetrics.ScopeMetrics {
+			for _, metric := range scopeMetrics.Metrics {
+				if metric.Gauge != nil {
+					for _, point := range metric.Gauge.DataPoints {
+						if value, ok := point.value(); ok {
+							tags := otlpTags(resourceMetrics.Resource.Attributes, point.Attributes)
+							events = append(events, &appchilada.Event{Type: appchilada.EventTypeGauge, Name: metric.Name, Value: round(value), Tags: tags})
+						}
+					}
+				}
+				if metric.Sum != nil {
+					for _, point := range metric.Sum.DataPoints {
+						tags := otlpTags(resourceMetrics.Resource.Attributes, point.Attributes)
+						if event := receiver.sumEvent(metric.Name, metric.Sum, point, tags); event != nil {
+							events = append(events, event)
+						}
+					}
+				}
+				if metric.Histogram != nil {
+					for _, point := range metric.Histogram.DataPoints {
+						tags := otlpTags(resourceMetrics.Resource.Attributes, point.Attributes)
+						events = append(events, receiver.histogramEvents(metric, point, tags)...)
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+func (point *otlpNumberPoint) value() (float64, bool) {
+	if value, ok := otlpNumber(point.AsDouble); ok {
+		return value, true
+	}
+	return otlpNumber(point.AsInt)
+}
+
+func (receiver *otlpReceiver) sumEvent(name string, sum *otlpNumbers, point *otlpNumberPoint, tags map[string]string) *appchilada.Event {
+	value, ok := point.value()
+	if !ok {
+		return nil
+	}
+	event := &appchilada.Event{Type: appchilada.EventTypeCount, Name: name, Tags: tags}
+	switch {
+	case !sum.IsMonotonic:
+		// An up down counter is a gauge, deltas change the last value
+		event.Type = appchilada.EventTypeGauge
+		event.Delta = sum.AggregationTemporality == otlpTemporalityDelta
+	case sum.AggregationTemporality == otlpTemporalityCumulative:
+		key := appchilada.SeriesKey(name, tags)
+		start, _ := otlpNumber(point.StartTimeUnixNano)
+		last := receiver.lastSums[key]
+		receiver.lastSums[key] = &otlpCumulative{sum: value, start: start, seen: time.Seconds()}
+		if last == nil {
+			// The first value is only the starting point for the next delta
+			return nil
+		}
+		if value >= last.sum && start == last.start {
+			// A lower value or a new start time means the counter was reset and the value is the delta
+			value -= last.sum
+		}
+	}
+	event.Value = round(value)
+	return event
+}
+
+// Factors that convert values of a duration unit to milliseconds, the unit of timings
+// Values of other units are stored unchanged
+var otlpDurationUnits = map[string]float64{
+	"ns":  1e-6,
+	"us":  1e-3,
+	"ms":  1,
+	"s":   1e3,
+	"min": 60e3,
+	"h":   3600e3,
+	"d":   86400e3,
+}
+
+// Convert the buckets of a histogram data point to weighted timing events with the
+// bucket midpoint as value, durations are converted to milliseconds
+func (receiver *otlpReceiver) histogramEvents(metric *otlpMetric, point *otlpHistogramPoint, tags map[string]string) []*appchilada.Event {
+	name, temporality := metric.Name, metric.Histogram.AggregationTemporality
+	scale, ok := otlpDurationUnits[metric.Unit]
+	if !ok {
+		scale = 1
+	}
+	counts := make([]float64, len(point.BucketCounts))
+	for i, count := range point.BucketCounts {
+		counts[i], _ = otlpNumber(count)
+	}
+	if temporality == otlpTemporalityCumulative {
+		key := appchilada.SeriesKey(name, tags)
+		start, _ := otlpNumber(point.StartTimeUnixNano)
+		last := receiver.lastBuckets[key]
+		receiver.lastBuckets[key] = &otlpCumulative{buckets: counts, bounds: point.ExplicitBounds, start: start, seen: time.Seconds()}
+		if last == nil || !equalBounds(last.bounds, point.ExplicitBounds) || len(last.buckets) != len(counts) {
+			// The first counts or the counts of a new bucket layout are the starting point for the next deltas
+			return nil
+		}
+		if start == last.start {
+			deltas := make([]float64, len(counts))
+			for i := range counts {
+				deltas[i] = counts[i] - last.buckets[i]
+				if deltas[i] < 0 {
+					// The histogram was reset, use the new counts
+					deltas = counts
+					break
+				}
+			}
+			counts = deltas
+		}
+	}
+	min, hasMin := otlpNumber(point.Min)
+	max, hasMax := otlpNumber(point.Max)
+	bounds := point.ExplicitBounds
+	var events []*appchilada.Event
+	for i, count := range counts {
+		if count <= 0 {
+			continue
+		}
+		var value float64
+		switch {
+		case len(bounds) == 0:
+			value = (min + max) / 2
+		case i == 0:
+			value = bounds[0]
+			if hasMin {
+				value = (min + bounds[0]) / 2
+			}
+		case i >= len(bounds):
+			value = bounds[len(bounds)-1]
+			if hasMax {
+				value = (bounds[len(bounds)-1] + max) / 2
+			}
+		default:
+			value = (bounds[i-1] + bounds[i]) / 2
+		}
+		events = append(events, &appchilada.Event{
+			Type:  appchilada.EventTypeTiming,
+			Name:  name,
+			Value: round(value * scale),
+			Tags:  tags,
+			// Every event represents all values of the bucket
+			SampleRate: 1 / count,
+		})
+	}
+	return events
+}
+
+func equalBounds(a []float64, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge resource and data point attributes, data point attributes take precedence
+func otlpTags(resourceAttributes []*otlpKeyValue, pointAttributes []*otlpKeyValue) map[string]string {
+	if len(resourceAttributes) == 0 && len(pointAttributes) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(resourceAttributes)+len(pointAttributes))
+	for _, attributes := range [][]*otlpKeyValue{resourceAttributes, pointAttributes} {
+		for _, attribute := range attributes {
+			tags[attribute.Key] = attribute.Value.String()
+		}
+	}
+	return tags
+}
+
+func round(value float64) int64 {
+	return int64(math.Floor(value + 0.5))
+}
+
+// Decode an ExportMetricsServiceRequest from the protobuf encoding
+func decodeOtlpMetricsRequest(data []byte, request *otlpMetricsRequest) os.Error {
+	r := newProtoReader(data)
+	for !r.done() {
+		field, _, _, data, err := r.next()
+		if err != nil {
+			return err
+		}
+		if field == 1 {
+			resourceMetrics := new(otlpResourceMetrics)
+			if err := decodeOtlpResourceMetrics(data, resourceMetrics); err != nil {
+				return err
+			}
+			request.ResourceMetrics = append(request.ResourceMetrics, resourceMetrics)
+		}
+	}
+	return nil
+}
+
+func decodeOtlpResourceMetrics(data []byte, resourceMetrics *otlpResourceMetrics) os.Error {
+	r := newProtoReader(data)
+	for !r.done() {
+		field, _, _, data, err := r.next()
+		if err != nil {
+			return err
+		}
+		switch field {
+		case 1:
+			// Resource with attributes in field 1
+			resource := newProtoReader(data)
+			for !resource.done() {
+				field, _, _, data, err := resource.next()
+				if err != nil {
+					return err
+				}
+				if field == 1 {
+					attribute, err := decodeOtlpKeyValue(data)
+					if err != nil {
+						return err
+					}
+					resourceMetrics.Resource.Attributes = append(resourceMetrics.Resource.Attributes, attribute)
+				}
+			}
+		case 2:
+			// Scope metrics with metrics in field 2
+			scopeMetrics := new(otlpScopeMetrics)
+			scope := newProtoReader(data)
+			for !scope.done() {
+				field, _, _, data, err := scope.next()
+				if err != nil {
+					return err
+				}
+				if field == 2 {
+					metric, err := decodeOtlpMetric(data)
+					if err != nil {
+						return err
+					}
+					scopeMetrics.Metrics = append(scopeMetrics.Metrics, metric)
+				}
+			}
+			resourceMetrics.ScopeMetrics = append(resourceMetrics.ScopeMetrics, scopeMetrics)
+		}
+	}
+	return nil
+}
+
+func decodeOtlpKeyValue(data []byte) (*otlpKeyValue, os.Error) {
+	keyValue := new(otlpKeyValue)
+	r := newProtoReader(data)
+	for !r.done() {
+		field, _, _, data, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			keyValue.Key = string(data)
+		case 2:
+			value := newProtoReader(data)
+			for !value.done() {
+				field, _, number, data, err := value.next()
+				if err != nil {
+					return nil, err
+				}
+				switch field {
+				case 1:
+					keyValue.Value.StringValue = string(data)
+				case 2:
+					keyValue.Value.BoolValue = number != 0
+				case 3:
+					keyValue.Value.IntValue = int64(number)
+				case 4:
+					keyValue.Value.DoubleValue = math.Float64frombits(number)
+				}
+			}
+		}
+	}
+	return keyValue, nil
+}
+
+func decodeOtlpMetric(data []byte) (*otlpMetric, os.Error) {
+	metric := new(otlpMetric)
+	r := newProtoReader(data)
+	for !r.done() {
+		field, _, _, data, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			metric.Name = string(data)
+		case 3:
+			metric.Unit = string(data)
+		case 5:
+			if metric.Gauge, err = decodeOtlpNumbers(data); err != nil {
+				return nil, err
+			}
+		case 7:
+			if metric.Sum, err = decodeOtlpNumbers(data); err != nil {
+				return nil, err
+			}
+		case 9:
+			if metric.Histogram, err = decodeOtlpHistogram(data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return metric, nil
+}
+
+// Decode a Gauge or Sum message
+func decodeOtlpNumbers(data []byte) (*otlpNumbers, os.Error) {
+	numbers := new(otlpNumbers)
+	r := newProtoReader(data)
+	for !r.done() {
+		field, _, number, data, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			point := new(otlpNumberPoint)
+			p := newProtoReader(data)
+			for !p.done() {
+				field, _, number, data, err := p.next()
+				if err != nil {
+					return nil, err
+				}
+				switch field {
+				case 2:
+					point.StartTimeUnixNano = number
+				case 4:
+					point.AsDouble = math.Float64frombits(number)
+				case 6:
+					point.AsInt = int64(number)
+				case 7:
+					attribute, err := decodeOtlpKeyValue(data)
+					if err != nil {
+						return nil, err
+					}
+					point.Attributes = append(point.Attributes, attribute)
+				}
+			}
+			numbers.DataPoints = append(numbers.DataPoints, point)
+		case 2:
+			numbers.AggregationTemporality = int(number)
+		case 3:
+			numbers.IsMonotonic = number != 0
+		}
+	}
+	return numbers, nil
+}
+
+func decodeOtlpHistogram(data []byte) (*otlpHistogram, os.Error) {
+	histogram := new(otlpHistogram)
+	r := newProtoReader(data)
+	for !r.done() {
+		field, _, number, data, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			point := new(otlpHistogramPoint)
+			p := newProtoReader(data)
+			for !p.done() {
+				field, wireType, number, data, err := p.next()
+				if err != nil {
+					return nil, err
+				}
+				switch field {
+				case 2:
+					point.StartTimeUnixNano = number
+				case 6:
+					if wireType == wireBytes {
+						for _, count := range packedFixed64(data) {
+							point.BucketCounts = append(point.BucketCounts, count)
+						}
+					} else {
+						point.BucketCounts = append(point.BucketCounts, number)
+					}
+				case 7:
+					if wireType == wireBytes {
+						point.ExplicitBounds = append(point.ExplicitBounds, packedDoubles(data)...)
+					} else {
+						point.ExplicitBounds = append(point.ExplicitBounds, math.Float64frombits(number))
+					}
+				case 9:
+					attribute, err := decodeOtlpKeyValue(data)
+					if err != nil {
+						return nil, err
+					}
+					point.Attributes = append(point.Attributes, attribute)
+				case 11:
+					point.Min = math.Float64frombits(number)
+				case 12:
+					point.Max = math.Float64frombits(number)
+				}
+			}
+			histogram.DataPoints = append(histogram.DataPoints, point)
+		case 2:
+			histogram.AggregationTemporality = int(number)
+		}
+	}
+	return histogram, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"time"
+	"appchilada"
+)
+
+// A pre-aggregated data point with the timestamp given by the client
+type point struct {
+	timestamp int64
+	event     *appchilada.Event
+}
+
+// Aggregate points by the interval of their timestamp and store every interval once it ended
+// Points of an interval that was already stored are stored at the end of the next interval and merged
+// by the backend, points of intervals that ended more than the lateness window ago are rejected
+// When a channel is sent to quit, the remaining points are stored and true is sent to that channel
+func pointWriter(pointChan chan *point, backend appchilada.Backend, interval int, quit chan chan bool) {
+	buckets := make(map[int64]appchilada.AggregateMap)
+	add := func(p *point) {
+		start := appchilada.IntervalStart(p.timestamp, interval)
+		if time.Seconds()-(start+int64(interval)) > appchilada.LatenessWindow {
+			appchilada.RejectLateEvent(p.event, p.timestamp)
+			return
+		}
+		m := buckets[start]
+		if m == nil {
+			m = make(appchilada.AggregateMap)
+			buckets[start] = m
+		}
+		m.AddEvent(p.event)
+	}
+	timer := appchilada.AlignedTick(interval)
+	for {
+		select {
+		case p := <-pointChan:
+			add(p)
+		case end := <-timer:
+			// Keep the buckets of intervals that are still open
+			open := make(map[int64]appchilada.AggregateMap)
+			closed := make(map[int64]appchilada.AggregateMap)
+			for start, m := range buckets {
+				if start+int64(interval) > end {
+					open[start] = m
+				} else {
+					closed[start] = m
+				}
+			}
+			storePoints(backend, closed)
+			buckets = open
+		case done := <-quit:
+			for drained := false; !drained; {
+				select {
+				case p := <-pointChan:
+					add(p)
+				default:
+					drained = true
+				}
+			}
+			storePoints(backend, buckets)
+			done <- true
+			return
+		}
+	}
+}
+
+func storePoints(backend appchilada.Backend, buckets map[int64]appchilada.AggregateMap) {
+	for start, m := range buckets {
+		if err := backend.Store(m, time.SecondsToLocalTime(start)); err != nil {
+			log.Printf("Error storing points: %s", err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"http"
+	"math"
+	"os"
+	"appchilada"
+)
+
+// Handle Prometheus remote_write requests (snappy compressed protobuf)
+// Samples are stored as gauges at their own timestamp, labels except __name__ become tags
+// Remote write has no metric types, so counters (_total) and the _bucket, _sum and _count series of
+// histograms and summaries are stored as gauges of their cumulative value as well
+func remoteWriteHandler(pointChan chan *point) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := readBody(r)
+		if err != nil {
+			bodyError(w, err)
+			return
+		}
+		data, err := snappyDecode(body)
+		if err == errRequestTooLarge {
+			bodyError(w, err)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Invalid snappy body: "+err.String(), http.StatusBadRequest)
+			return
+		}
+		points, err := decodeWriteRequest(data)
+		if err != nil {
+			http.Error(w, "Invalid remote write request: "+err.String(), http.StatusBadRequest)
+			return
+		}
+		for _, p := range points {
+			pointChan <- p
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Decode the time series of a WriteRequest to points
+func decodeWriteRequest(data []byte) ([]*point, os.Error) {
+	var points []*point
+	r := newProtoReader(data)
+	for !r.done() {
+		field, _, _, data, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if field == 1 {
+			seriesPoints, err := decodeTimeSeries(data)
+			if err != nil {
+				return nil, err
+			}
+			points = append(points, seriesPoints...)
+		}
+	}
+	return points, nil
+}
+
+func decodeTimeSeries(data []byte) ([]*point, os.Error) {
+	var name string
+	tags := make(map[string]string)
+	var points []*point
+	r := newProtoReader(data)
+	for !r.done() {
+		field, _, _, data, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			labelName, labelValue, err := decodeLabel(data)
+			if err != nil {
+				return nil, err
+			}
+			if labelName == "__name__" {
+				name = labelValue
+			} else {
+				tags[labelName] = labelValue
+			}
+		case 2:
+			value, timestamp, err := decodeSample(data)
+			if err != nil {
+				return nil, err
+			}
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				// Stale markers and infinite values cannot be stored
+				continue
+			}
+			points = append(points, &point{
+				// Prometheus timestamps are in milliseconds
+				timestamp: timestamp / 1000,
+				event:     &appchilada.Event{Type: appchilada.EventTypeGauge, Value: round(value)},
+			})
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("time series without __name__ label")
+	}
+	// Labels and samples can appear in any order
+	for _, p := range points {
+		p.event.Name = name
+		p.event.Tags = tags
+	}
+	return points, nil
+}
+
+func decodeLabel(data []byte) (name string, value string, err os.Error) {
+	r := newProtoReader(data)
+	for !r.done() {
+		field, _, _, data, err := r.next()
+		if err != nil {
+			return "", "", err
+		}
+		switch field {
+		case 1:
+			name = string(data)
+		case 2:
+			value = string(data)
+		}
+	}
+	return
+}
+
+func decodeSample(data []byte) (value float64, timestamp int64, err os.Error) {
+	r := newProtoReader(data)
+	for !r.done() {
+		field, _, number, _, err := r.next()
+		if err != nil {
+			return 0, 0, err
+		}
+		switch field {
+		case 1:
+			value = math.Float64frombits(number)
+		case 2:
+			timestamp = int64(number)
+		}
+	}
+	return
+}
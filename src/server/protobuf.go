@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+)
+
+// Protocol buffer wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errProtobufTruncated = os.NewError("protobuf message truncated")
+
+// A minimal reader for the protocol buffer wire format, just enough to decode the
+// messages of the ingestion protocols without generated code
+type protoReader struct {
+	buf []byte
+	pos int
+}
+
+func newProtoReader(buf []byte) *protoReader {
+	return &protoReader{buf: buf}
+}
+
+func (r *protoReader) done() bool {
+	return r.pos >= len(r.buf)
+}
+
+// Read the next field of the message, value is set for numeric wire types and data for length delimited fields
+func (r *protoReader) next() (field int, wireType int, value uint64, data []byte, err os.Error) {
+	key, err := r.varint()
+	if err != nil {
+		return
+	}
+	field, wireType = int(key>>3), int(key&7)
+	switch wireType {
+	case wireVarint:
+		value, err = r.varint()
+	case wireFixed64:
+		if r.pos+8 > len(r.buf) {
+			return 0, 0, 0, nil, errProtobufTruncated
+		}
+		value = binary.LittleEndian.Uint64(r.buf[r.pos:])
+		r.pos += 8
+	case wireFixed32:
+		if r.pos+4 > len(r.buf) {
+			return 0, 0, 0, nil, errProtobufTruncated
+		}
+		value = uint64(binary.LittleEndian.Uint32(r.buf[r.pos:]))
+		r.pos += 4
+	case wireBytes:
+		var length uint64
+		if length, err = r.varint(); err != nil {
+			return
+		}
+		if uint64(len(r.buf)-r.pos) < length {
+			return 0, 0, 0, nil, errProtobufTruncated
+		}
+		data = r.buf[r.pos : r.pos+int(length)]
+		r.pos += int(length)
+	default:
+		err = os.NewError("unsupported protobuf wire type")
+	}
+	return
+}
+
+func (r *protoReader) varint() (uint64, os.Error) {
+	var value uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		if r.pos >= len(r.buf) {
+			return 0, errProtobufTruncated
+		}
+		b := r.buf[r.pos]
+		r.pos++
+		value |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return value, nil
+		}
+	}
+	return 0, os.NewError("protobuf varint overflow")
+}
+
+// Decode a packed repeated fixed64 field
+func packedFixed64(data []byte) []uint64 {
+	values := make([]uint64, 0, len(data)/8)
+	for i := 0; i+8 <= len(data); i += 8 {
+		values = append(values, binary.LittleEndian.Uint64(data[i:]))
+	}
+	return values
+}
+
+// Decode a packed repeated double field
+func packedDoubles(data []byte) []float64 {
+	values := make([]float64, 0, len(data)/8)
+	for _, bits := range packedFixed64(data) {
+		values = append(values, math.Float64frombits(bits))
+	}
+	return values
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"sync"
+	"time"
+	"appchilada"
+	"appchilada/frontend"
+)
+
+// Flags of the backends, the backends are replaced when one of them changes
+var backendFlags = []string{"couchdb", "spool", "retention"}
+
+// Flags of the config file that only take effect after a restart
+var restartFlags = []string{"interval"}
+
+// A backend that can be replaced while the server is running
+type switchableBackend struct {
+	mutex   sync.RWMutex
+	backend appchilada.Backend
+	// Aggregations stored while the backend is closed to be replaced, they are stored in the new backend
+	pending []*pendingStore
+}
+
+type pendingStore struct {
+	m appchilada.AggregateMap
+	t *time.Time
+}
+
+var errReplacingBackend = os.NewError("backend is being replaced")
+
+func (s *switchableBackend) Open() os.Error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.backend.Open()
+}
+
+func (s *switchableBackend) Store(m appchilada.AggregateMap, t *time.Time) os.Error {
+	s.mutex.RLock()
+	if s.backend != nil {
+		defer s.mutex.RUnlock()
+		return s.backend.Store(m, t)
+	}
+	s.mutex.RUnlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.backend != nil {
+		return s.backend.Store(m, t)
+	}
+	s.pending = append(s.pending, &pendingStore{m, t})
+	return nil
+}
+
+func (s *switchableBackend) Read(name string, interval appchilada.Interval, filter appchilada.TagFilter) ([]*appchilada.Results, os.Error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.backend == nil {
+		return nil, errReplacingBackend
+	}
+	return s.backend.Read(name, interval, filter)
+}
+
+func (s *switchableBackend) Names() ([]string, os.Error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.backend == nil {
+		return nil, errReplacingBackend
+	}
+	return s.backend.Names()
+}
+
+func (s *switchableBackend) Close() os.Error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.backend.Close()
+}
+
+// Get the current backend
+func (s *switchableBackend) current() appchilada.Backend {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.backend
+}
+
+// Open a new backend and replace the current one, the lock is only held to swap them
+// If closeFirst is set, the current backend is closed before opening the new one and
+// aggregations stored in between are stored in the new backend once it is open,
+// otherwise it is closed in the background after replacing it
+// The current backend is kept if the new one could not be opened
+func (s *switchableBackend) replace(next appchilada.Backend, closeFirst bool) os.Error {
+	if !closeFirst {
+		if err := next.Open(); err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		previous := s.backend
+		s.backend = next
+		s.mutex.Unlock()
+		if previous != nil {
+			go func() {
+				if err := previous.Close(); err != nil {
+					log.Printf("Error closing backend: %v", err)
+				}
+			}()
+		}
+		return nil
+	}
+
+	s.mutex.Lock()
+	previous := s.backend
+	s.backend = nil
+	s.mutex.Unlock()
+	if err := previous.Close(); err != nil {
+		log.Printf("Error closing backend: %v", err)
+	}
+	err := next.Open()
+	if err != nil {
+		if err := previous.Open(); err != nil {
+			log.Printf("Error reopening backend: %v", err)
+		}
+		next = previous
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.backend = next
+	for _, store := range s.pending {
+		if err := next.Store(store.m, store.t); err != nil {
+			log.Printf("Error storing aggregation: %v", err)
+		}
+	}
+	s.pending = nil
+	return err
+}
+
+// Get the values of all flags that can be set by the config file
+func configFlagValues() map[string]string {
+	values := make(map[string]string)
+	for _, name := range configFlags {
+		values[name] = flag.Lookup(name).Value.String()
+	}
+	return values
+}
+
+func anyChanged(names []string, changed map[string]bool) bool {
+	for _, name := range names {
+		if changed[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// Read the config file again and apply the changes without dropping events
+// Backends and listeners with changed flags are replaced, an invalid config is ignored
+func reloadConfig(eventChan chan appchilada.Event, pointChan chan *point) {
+	if *configFile == "" {
+		log.Printf("No config file to reload")
+		return
+	}
+	previous := configFlagValues()
+	restore := func() {
+		for name, value := range previous {
+			flag.Set(name, value)
+		}
+	}
+	if err := loadConfig(*configFile, commandLine); err != nil {
+		log.Printf("Error reloading config, keeping the current config: %v", err)
+		restore()
+		return
+	}
+	if errs := validateFlags(); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("Invalid configuration: %v", err)
+		}
+		log.Printf("Keeping the current config")
+		restore()
+		return
+	}
+
+	changed := make(map[string]bool)
+	for _, name := range configFlags {
+		if value := flag.Lookup(name).Value.String(); value != previous[name] {
+			log.Printf("Config changed: -%s %q -> %q", name, previous[name], value)
+			changed[name] = true
+		}
+	}
+	if len(changed) == 0 {
+		log.Printf("Config unchanged")
+		return
+	}
+	for _, name := range restartFlags {
+		if changed[name] {
+			log.Printf("Config change of -%s takes effect after a restart", name)
+		}
+	}
+
+	if anyChanged(backendFlags, changed) {
+		// Spool files may be reused by the new backend, so a spooling backend has to stop first
+		if err := backend.replace(initializeBackends(*couchDbs), previous["spool"] != ""); err != nil {
+			log.Printf("Error opening backend, keeping the current backend: %v", err)
+			for _, name := range backendFlags {
+				flag.Set(name, previous[name])
+			}
+		} else {
+			log.Printf("Replaced backend")
+		}
+	}
+
+	frontend.SetDevelopment(*development)
+
+	for _, name := range listenerNames {
+		if !anyChanged(listenerFlags[name], changed) {
+			continue
+		}
+		stopListener(name)
+		if err := startListener(name, eventChan, pointChan); err != nil {
+			log.Printf("Error restarting %s listener: %v", name, err)
+		}
+	}
+}
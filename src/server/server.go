@@ -1,84 +1,240 @@
 package main
 
 import (
-	// "fmt"
 	"flag"
-	"json"
+	"fmt"
+	"http"
 	"log"
 	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
 	"appchilada"
 	"appchilada/frontend"
 )
 
+var configFile *string = flag.String("config", "", "JSON config file, flags given on the command line override its values")
 var port *int = flag.Int("port", 8686, "Listen port")
 var address *string = flag.String("address", "0.0.0.0", "Listen address")
+var tcpPort *int = flag.Int("tcp-port", 8686, "TCP listen port (0 to disable)")
+var tcpAddress *string = flag.String("tcp-address", "0.0.0.0", "TCP listen address")
+var unixSocket *string = flag.String("unix-socket", "", "Unix stream socket path (empty to disable)")
+var unixgramSocket *string = flag.String("unixgram-socket", "", "Unix datagram socket path (empty to disable)")
+var graphitePort *int = flag.Int("graphite-port", 0, "Graphite plaintext listen port (0 to disable)")
+var graphiteAddress *string = flag.String("graphite-address", "0.0.0.0", "Graphite plaintext listen address")
+var graphiteCounts *string = flag.String("graphite-counts", "", "Graphite paths matching this pattern are counts, all others gauges")
+var influxPort *int = flag.Int("influx-port", 0, "InfluxDB line protocol UDP listen port (0 to disable)")
+var influxAddress *string = flag.String("influx-address", "0.0.0.0", "InfluxDB line protocol UDP listen address")
+var socketMode *string = flag.String("socket-mode", "0666", "File permissions of Unix sockets (octal)")
 var debug *bool = flag.Bool("debug", false, "Log debug messages")
 var interval *int = flag.Int("interval", 10, "Event flush interval (in seconds)")
+var percentiles *string = flag.String("percentiles", "50,90,95,99", "Comma separated list of timing percentiles")
+var lateness *int = flag.Int("lateness", 60, "Seconds after an interval was stored in which late events are merged into it")
+var shards *int = flag.Int("shards", 1, "Number of workers that reduce events in parallel")
+var eventBuffer *int = flag.Int("event-buffer", 10000, "Events buffered for the aggregator, so receiving does not wait for reducing")
+var shutdownTimeout *int = flag.Int("shutdown-timeout", 10, "Seconds to store remaining events when shutting down")
+var retryQueue *int = flag.Int("retry-queue", 100, "Aggregations kept for retrying when the backend fails")
+var retryMaxDelay *int = flag.Int("retry-max-delay", 60, "Maximum seconds between retries of a failed store")
+var couchDbs *string = flag.String("couchdb", "127.0.0.1:5984/appchilada_test", "Comma separated CouchDB backends as host:port/database, the first is read from")
+var spool *string = flag.String("spool", "", "Path prefix of the files aggregations are spooled to until they are stored, one per database named <spool>.<host>_<port>_<database> (empty to retry from memory)")
+var setThreshold *int = flag.Int("set-threshold", 1000, "Unique set members before switching to an approximate count")
+var retention *int = flag.Int("retention", 0, "Days records are kept in the backends (0 to keep them forever)")
+var frontendAddress *string = flag.String("frontend-address", ":8080", "Frontend HTTP listen address")
+var development *bool = flag.Bool("development", true, "Reload frontend templates on every request")
 
-var backend appchilada.Backend
+// Backend of all aggregators and the frontend, replaced when the config is reloaded
+var backend = &switchableBackend{}
+
+// Flags given on the command line, they take precedence over the config file
+var commandLine map[string]bool
 
 func main() {
 	flag.Parse()
+	commandLine = commandLineFlags()
+	if *configFile != "" {
+		if err := loadConfig(*configFile, commandLine); err != nil {
+			log.Fatalf("Error loading config: %v", err)
+		}
+	}
+	if errs := validateFlags(); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("Invalid configuration: %v", err)
+		}
+		os.Exit(2)
+	}
 
-	// Initialize the UDP socket to listen to event messages
-	socket := initializeSocket(*address, *port)
-	defer socket.Close()
+	appchilada.SetSketchThreshold = *setThreshold
+	appchilada.Percentiles, _ = parsePercentiles(*percentiles)
+	appchilada.LatenessWindow = int64(*lateness)
+	appchilada.RetryMaxDelay = int64(*retryMaxDelay)
 
-	// Initialize the backend
-	// TODO Support multiple, configurable backends
-	backend = &appchilada.CouchDbBackend{
-		Host:         "127.0.0.1",
-		Port:         "5984",
-		DatabaseName: "appchilada_test",
-	}
-	if err := backend.Open(); err != nil {
+	// Initialize the backends
+	if err := backend.replace(initializeBackends(*couchDbs), false); err != nil {
 		log.Fatalf("Error opening backend: %v", err)
 	}
 
-	go eventLoop(backend, socket)
+	eventChan := make(chan appchilada.Event, *eventBuffer)
+	aggregatorQuit := make(chan chan bool)
+	// This is where all the aggregation is done
+	if *shards > 1 {
+		// Shards only run in parallel with enough processors
+		if runtime.GOMAXPROCS(0) < *shards {
+			runtime.GOMAXPROCS(*shards)
+		}
+		go appchilada.ShardedAggregator(eventChan, backend, *interval, *shards, aggregatorQuit)
+	} else {
+		go appchilada.Aggregator(eventChan, backend, *interval, aggregatorQuit)
+	}
 
-	frontend.Development = true
-	err := frontend.ListenAndServeHttp(backend)
-	if err != nil {
+	// Pre-aggregated points are stored by their own timestamp
+	pointChan := make(chan *point)
+	pointWriterQuit := make(chan chan bool)
+	go pointWriter(pointChan, backend, *interval, pointWriterQuit)
+
+	http.HandleFunc("/events", trackHandler(eventsHandler(eventChan)))
+	http.HandleFunc("/write", trackHandler(influxWriteHandler(eventChan)))
+	http.HandleFunc("/v1/metrics", trackHandler(newOtlpReceiver().handler(eventChan)))
+	http.HandleFunc("/api/v1/write", trackHandler(remoteWriteHandler(pointChan)))
+	http.HandleFunc("/status", statusHandler)
+
+	frontend.SetDevelopment(*development)
+	if err := frontend.Handle(backend); err != nil {
 		log.Fatal(err)
 	}
+
+	for _, name := range listenerNames {
+		if err := startListener(name, eventChan, pointChan); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Reload the config on SIGHUP until SIGINT or SIGTERM
+	for waitForSignal() == os.SIGHUP {
+		reloadConfig(eventChan, pointChan)
+	}
+	shutdown([]chan chan bool{aggregatorQuit, pointWriterQuit}, backend, *shutdownTimeout)
 }
 
-func eventLoop(backend appchilada.Backend, socket *net.UDPConn) {
-	eventChan := make(chan appchilada.Event)
-	// This is where all the aggregation is done
-	go appchilada.Aggregator(eventChan, backend, *interval)
+// Create a backend storing to all CouchDB databases in a comma separated list
+// Each database is retried independently from a spool file or queue
+func initializeBackends(list string) appchilada.Backend {
+	specs := strings.Split(list, ",")
+	multi := &appchilada.MultiBackend{}
+	for _, spec := range specs {
+		couchDb, err := parseCouchDb(strings.TrimSpace(spec))
+		if err != nil {
+			log.Fatal(err)
+		}
+		couchDb.Retention = int64(*retention) * 24 * 60 * 60
+		if *spool != "" {
+			multi.Backends = append(multi.Backends, appchilada.NewSpoolBackend(couchDb, spoolPath(*spool, couchDb)))
+		} else {
+			multi.Backends = append(multi.Backends, appchilada.NewRetryBackend(couchDb, *retryQueue))
+		}
+	}
+	if len(multi.Backends) == 1 {
+		return multi.Backends[0]
+	}
+	return multi
+}
+
+// Get the spool file of a database, named after the database so it stays with the database
+// when the list of backends changes
+func spoolPath(spool string, couchDb *appchilada.CouchDbBackend) string {
+	name := []byte(couchDb.Host + "_" + couchDb.Port + "_" + couchDb.DatabaseName)
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			name[i] = '_'
+		}
+	}
+	return spool + "." + string(name)
+}
+
+// Parse a CouchDB database given as host:port/database
+func parseCouchDb(spec string) (*appchilada.CouchDbBackend, os.Error) {
+	slash := strings.Index(spec, "/")
+	colon := strings.Index(spec, ":")
+	if slash < 0 || colon < 1 || colon > slash || slash == len(spec)-1 {
+		return nil, fmt.Errorf("Invalid CouchDB backend %q, must be host:port/database", spec)
+	}
+	if port, err := strconv.Atoi(spec[colon+1 : slash]); err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("Invalid CouchDB backend %q, port must be between 1 and 65535", spec)
+	}
+	return &appchilada.CouchDbBackend{
+		Host:         spec[:colon],
+		Port:         spec[colon+1 : slash],
+		DatabaseName: spec[slash+1:],
+	}, nil
+}
 
-	buffer := make([]byte, 4096)
+// Parse a comma separated list of percentiles
+func parsePercentiles(list string) ([]float64, os.Error) {
+	values := strings.Split(list, ",")
+	result := make([]float64, 0, len(values))
+	for _, value := range values {
+		p, err := strconv.Atof64(strings.TrimSpace(value))
+		if err != nil || p <= 0 || p > 100 {
+			return nil, fmt.Errorf("Invalid percentile %q, must be a number between 0 and 100", value)
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+// Size of the datagram buffer, larger than the largest UDP payload
+const maxDatagramSize = 64 * 1024
+
+// Read datagrams from a UDP or Unix datagram socket and parse them with the given parser
+func eventLoop(eventChan chan appchilada.Event, socket net.Conn, parse parser) {
+	defer forgetListener(socket)
+	buffer := make([]byte, maxDatagramSize)
 	for {
 		if n, err := socket.Read(buffer); err != nil {
+			if isClosed(socket) {
+				return
+			}
 			log.Printf("Socket read error: %v", err)
+		} else if n == len(buffer) {
+			// Only Unix datagrams can be larger, the rest of the datagram was discarded
+			log.Printf("Skipping datagram of more than %d bytes", len(buffer))
 		} else {
-			handleMessage(eventChan, buffer[:n])
+			handleMessage(eventChan, buffer[:n], parse)
 		}
 	}
 }
 
-func initializeSocket(address string, port int) *net.UDPConn {
+func initializeSocket(address string, port int) (*net.UDPConn, os.Error) {
 	ip := net.ParseIP(address)
 	socket, err := net.ListenUDP("udp4", &net.UDPAddr{
 		IP:   ip,
 		Port: port,
 	})
 	if err != nil {
-		log.Fatalf("Error opening socket: %v", err)
-	} else {
-		log.Printf("Starting appchilada server on udp://%s:%d", ip.String(), port)
+		return nil, fmt.Errorf("Error opening socket: %v", err)
+	}
+	log.Printf("Starting appchilada server on udp://%s:%d", ip.String(), port)
+	return socket, nil
+}
+
+// Parses the events of a message, errors of single events do not stop parsing
+type parser func(message []byte) ([]*appchilada.Event, []os.Error)
+
+// Parse a message and send the events to the channel
+func handleMessage(eventChan chan appchilada.Event, message []byte, parse parser) {
+	events, errs := parse(message)
+	for _, err := range errs {
+		log.Printf("Message error: %v", err)
+	}
+	for _, event := range events {
+		eventChan <- *event
 	}
-	return socket
 }
 
-// Handle a JSON encoded message and send an event to the channel
-func handleMessage(eventChan chan appchilada.Event, message []byte) {
-	var event appchilada.Event
-	if err := json.Unmarshal(message, &event); err != nil {
-		log.Printf("JSON decode error: %v", err)
-		return
+// Parse JSON encoded events or StatsD lines, the format is detected by the first character
+func parseMessage(message []byte) ([]*appchilada.Event, []os.Error) {
+	if isJsonMessage(message) {
+		return parseJsonMessage(message)
 	}
-	eventChan <- event
+	return parseStatsdMessage(message)
 }
@@ -0,0 +1,708 @@
+package main
+
+import (
+	"appchilada"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"http"
+	"http/httptest"
+	"io/ioutil"
+	"json"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSnappyDecode(t *testing.T) {
+	// Length 12, a literal "abcd" and a copy of 8 bytes at offset 4 that overlaps its output
+	data, err := snappyDecode([]byte{12, 3 << 2, 'a', 'b', 'c', 'd', (8-4)<<2 | 1, 4})
+	if err != nil || string(data) != "abcdabcdabcd" {
+		t.Errorf("Expected %q, got %q (%v)", "abcdabcdabcd", data, err)
+	}
+	long := bytes.Repeat([]byte{'x'}, 100)
+	// Literals of 61 bytes or more have their length in the following bytes
+	data, err = snappyDecode(append([]byte{100, 60 << 2, 99}, long...))
+	if err != nil || !bytes.Equal(data, long) {
+		t.Errorf("Expected %d bytes of literal, got %q (%v)", 100, data, err)
+	}
+	corrupt := [][]byte{
+		{},
+		{4, 3 << 2, 'a', 'b'},
+		{8, 3 << 2, 'a', 'b', 'c', 'd', (4-4)<<2 | 1, 5},
+		{3, 3 << 2, 'a', 'b', 'c', 'd'},
+	}
+	for _, c := range corrupt {
+		if data, err := snappyDecode(c); err == nil {
+			t.Errorf("Expected error decoding %v, got %q", c, data)
+		}
+	}
+}
+
+// Encode a varint for building protocol buffer messages
+func protoVarint(buf *bytes.Buffer, value uint64) {
+	for value >= 0x80 {
+		buf.WriteByte(byte(value) | 0x80)
+		value >>= 7
+	}
+	buf.WriteByte(byte(value))
+}
+
+// Encode a length delimited field with the concatenated data
+func protoBytes(field int, data ...[]byte) []byte {
+	buf := new(bytes.Buffer)
+	protoVarint(buf, uint64(field<<3|wireBytes))
+	value := bytes.Join(data, nil)
+	protoVarint(buf, uint64(len(value)))
+	buf.Write(value)
+	return buf.Bytes()
+}
+
+func protoFixed64(field int, value uint64) []byte {
+	buf := new(bytes.Buffer)
+	protoVarint(buf, uint64(field<<3|wireFixed64))
+	binary.Write(buf, binary.LittleEndian, value)
+	return buf.Bytes()
+}
+
+func protoUint(field int, value uint64) []byte {
+	buf := new(bytes.Buffer)
+	protoVarint(buf, uint64(field<<3|wireVarint))
+	protoVarint(buf, value)
+	return buf.Bytes()
+}
+
+// An OTLP request with a gauge, a cumulative sum and a delta histogram in JSON
+func otlpJsonRequest(sum int) []byte {
+	return []byte(fmt.Sprintf(`{"resourceMetrics": [{"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "svc"}}]},
+		"scopeMetrics": [{"metrics": [
+			{"name": "g", "gauge": {"dataPoints": [{"asDouble": 3.4, "attributes": [{"key": "k", "value": {"intValue": "5"}}]}]}},
+			{"name": "s", "sum": {"aggregationTemporality": 2, "isMonotonic": true, "dataPoints": [{"startTimeUnixNano": "1", "asInt": "%d"}]}},
+			{"name": "h", "histogram": {"aggregationTemporality": 1, "dataPoints": [{"bucketCounts": ["1", "2", "0"], "explicitBounds": [10, 20], "min": 2, "max": 30}]}},
+			{"name": "d", "unit": "s", "histogram": {"aggregationTemporality": 1, "dataPoints": [{"bucketCounts": ["1", "1", "0"], "explicitBounds": [0.005, 0.01], "min": 0.001, "max": 0.02}]}}
+		]}]}]}`, sum))
+}
+
+// The same request as otlpJsonRequest in protobuf
+func otlpProtoRequest(sum int) []byte {
+	keyValue := func(key string, value []byte) []byte {
+		return bytes.Join([][]byte{protoBytes(1, []byte(key)), protoBytes(2, value)}, nil)
+	}
+	resource := protoBytes(1, protoBytes(1, keyValue("service.name", protoBytes(1, []byte("svc")))))
+	gauge := protoBytes(5, protoBytes(1, protoFixed64(4, math.Float64bits(3.4)), protoBytes(7, keyValue("k", protoUint(3, 5)))))
+	sumMetric := protoBytes(7, protoBytes(1, protoFixed64(2, 1), protoFixed64(6, uint64(sum))), protoUint(2, 2), protoUint(3, 1))
+	counts := new(bytes.Buffer)
+	binary.Write(counts, binary.LittleEndian, []uint64{1, 2, 0})
+	bounds := new(bytes.Buffer)
+	binary.Write(bounds, binary.LittleEndian, []float64{10, 20})
+	histogramPoint := protoBytes(1, protoBytes(6, counts.Bytes()), protoBytes(7, bounds.Bytes()),
+		protoFixed64(11, math.Float64bits(2)), protoFixed64(12, math.Float64bits(30)))
+	histogram := protoBytes(9, histogramPoint, protoUint(2, 1))
+	counts = new(bytes.Buffer)
+	binary.Write(counts, binary.LittleEndian, []uint64{1, 1, 0})
+	bounds = new(bytes.Buffer)
+	binary.Write(bounds, binary.LittleEndian, []float64{0.005, 0.01})
+	durationPoint := protoBytes(1, protoBytes(6, counts.Bytes()), protoBytes(7, bounds.Bytes()),
+		protoFixed64(11, math.Float64bits(0.001)), protoFixed64(12, math.Float64bits(0.02)))
+	duration := protoBytes(9, durationPoint, protoUint(2, 1))
+	metrics := protoBytes(2,
+		protoBytes(2, protoBytes(1, []byte("g")), gauge),
+		protoBytes(2, protoBytes(1, []byte("s")), sumMetric),
+		protoBytes(2, protoBytes(1, []byte("h")), histogram),
+		protoBytes(2, protoBytes(1, []byte("d")), protoBytes(3, []byte("s")), duration))
+	return protoBytes(1, resource, metrics)
+}
+
+// Describe events as "type key value sample rate" for comparison
+func describeEvents(events []*appchilada.Event) []string {
+	described := make([]string, len(events))
+	for i, e := range events {
+		described[i] = fmt.Sprintf("%d %s %d %g", e.Type, appchilada.SeriesKey(e.Name, e.Tags), e.Value, e.SampleRate)
+	}
+	return described
+}
+
+func TestOtlpDecode(t *testing.T) {
+	decoders := map[string]func(data []byte, request *otlpMetricsRequest) os.Error{
+		"json": func(data []byte, request *otlpMetricsRequest) os.Error {
+			return json.Unmarshal(data, request)
+		},
+		"protobuf": decodeOtlpMetricsRequest,
+	}
+	encoders := map[string]func(sum int) []byte{"json": otlpJsonRequest, "protobuf": otlpProtoRequest}
+	// Durations in seconds are converted to milliseconds
+	first := []string{"2 g;k=5;service.name=svc 3 0", "1 h;service.name=svc 6 1", "1 h;service.name=svc 15 0.5",
+		"1 d;service.name=svc 3 1", "1 d;service.name=svc 8 1"}
+	// The cumulative sum is converted to the delta to the first request
+	second := []string{"2 g;k=5;service.name=svc 3 0", "0 s;service.name=svc 15 0", "1 h;service.name=svc 6 1", "1 h;service.name=svc 15 0.5",
+		"1 d;service.name=svc 3 1", "1 d;service.name=svc 8 1"}
+	for encoding, decode := range decoders {
+		receiver := newOtlpReceiver()
+		for i, sum := range []int{10, 25} {
+			request := new(otlpMetricsRequest)
+			if err := decode(encoders[encoding](sum), request); err != nil {
+				t.Errorf("Error decoding %s request: %v", encoding, err)
+				continue
+			}
+			expected := first
+			if i > 0 {
+				expected = second
+			}
+			events := describeEvents(receiver.events(request))
+			if strings.Join(events, ", ") != strings.Join(expected, ", ") {
+				t.Errorf("Expected events %v from %s request %d, got %v", expected, encoding, i+1, events)
+			}
+		}
+	}
+}
+
+func TestOtlpCumulativeResets(t *testing.T) {
+	receiver := newOtlpReceiver()
+	sum := &otlpNumbers{AggregationTemporality: otlpTemporalityCumulative, IsMonotonic: true}
+	sumEvent := func(value int64, start string) *appchilada.Event {
+		return receiver.sumEvent("s", sum, &otlpNumberPoint{AsInt: value, StartTimeUnixNano: start}, nil)
+	}
+	sumEvent(10, "1")
+	// A new start time means the value counts from the reset
+	if event := sumEvent(30, "2"); event == nil || event.Value != 30 {
+		t.Errorf("Expected count %d after a reset, got %v", 30, event)
+	}
+	receiver.evicted = 0
+	receiver.lastSums["s"].seen -= otlpSeriesTimeout
+	receiver.evict(receiver.lastSums["s"].seen + otlpSeriesTimeout)
+	if len(receiver.lastSums) != 0 {
+		t.Errorf("Expected series that were not seen to be evicted, got %v", receiver.lastSums)
+	}
+	if event := sumEvent(40, "2"); event != nil {
+		t.Errorf("Expected no count for the first value after eviction, got %v", event)
+	}
+
+	histogram := func(counts []interface{}, bounds []float64) []*appchilada.Event {
+		point := &otlpHistogramPoint{BucketCounts: counts, ExplicitBounds: bounds}
+		metric := &otlpMetric{Name: "h", Histogram: &otlpHistogram{AggregationTemporality: otlpTemporalityCumulative}}
+		return receiver.histogramEvents(metric, point, nil)
+	}
+	histogram([]interface{}{1.0, 1.0}, []float64{10})
+	// A new bucket layout starts over instead of emitting the cumulative counts
+	if events := histogram([]interface{}{2.0, 3.0, 1.0}, []float64{10, 20}); len(events) != 0 {
+		t.Errorf("Expected no timings after the bucket layout changed, got %v", describeEvents(events))
+	}
+	events := describeEvents(histogram([]interface{}{3.0, 3.0, 1.0}, []float64{10, 20}))
+	if len(events) != 1 || events[0] != "1 h 10 1" {
+		t.Errorf("Expected one timing of the first bucket, got %v", events)
+	}
+}
+
+// Backend that records stores, Open blocks until opened is closed
+type testBackend struct {
+	mutex  sync.Mutex
+	stored []appchilada.AggregateMap
+	opened chan bool
+	closed chan bool
+}
+
+func newTestBackend() *testBackend {
+	return &testBackend{opened: make(chan bool), closed: make(chan bool)}
+}
+
+func (backend *testBackend) Open() os.Error {
+	<-backend.opened
+	return nil
+}
+
+func (backend *testBackend) Store(m appchilada.AggregateMap, t *time.Time) os.Error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	backend.stored = append(backend.stored, m)
+	return nil
+}
+
+func (backend *testBackend) Read(name string, interval appchilada.Interval, filter appchilada.TagFilter) ([]*appchilada.Results, os.Error) {
+	return nil, nil
+}
+
+func (backend *testBackend) Names() ([]string, os.Error) {
+	return nil, nil
+}
+
+func (backend *testBackend) Close() os.Error {
+	close(backend.closed)
+	return nil
+}
+
+func (backend *testBackend) storedCount() int {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	return len(backend.stored)
+}
+
+// Store in the switchable backend, fails the test if the store blocks
+func storeWithoutBlocking(t *testing.T, s *switchableBackend) {
+	stored := make(chan bool)
+	go func() {
+		s.Store(make(appchilada.AggregateMap), time.LocalTime())
+		stored <- true
+	}()
+	select {
+	case <-stored:
+	case <-time.After(1e9):
+		t.Fatalf("Expected store not to block while the backend is replaced")
+	}
+}
+
+func TestSwitchableBackendReplace(t *testing.T) {
+	s := &switchableBackend{}
+	first := newTestBackend()
+	close(first.opened)
+	if err := s.replace(first, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stores go to the current backend while the next one is opened
+	second := newTestBackend()
+	replaced := make(chan os.Error)
+	go func() { replaced <- s.replace(second, false) }()
+	storeWithoutBlocking(t, s)
+	close(second.opened)
+	<-replaced
+	<-first.closed
+	if first.storedCount() != 1 || second.storedCount() != 0 {
+		t.Errorf("Expected the store in the first backend, got %d and %d", first.storedCount(), second.storedCount())
+	}
+
+	// Stores are kept while the backend is closed first and stored in the next one
+	third := newTestBackend()
+	go func() { replaced <- s.replace(third, true) }()
+	<-second.closed
+	storeWithoutBlocking(t, s)
+	close(third.opened)
+	<-replaced
+	if second.storedCount() != 0 || third.storedCount() != 1 {
+		t.Errorf("Expected the store in the third backend, got %d and %d", second.storedCount(), third.storedCount())
+	}
+}
+
+func TestConnectionTrackerCloseAndWait(t *testing.T) {
+	tracker := newConnectionTracker()
+	eventChan := make(chan appchilada.Event, 1)
+	conn, client := net.Pipe()
+	e := tracker.add(conn)
+	finished := make(chan bool, 1)
+	go func() {
+		defer tracker.remove(e)
+		readLines(conn, "Event", func(line []byte) {
+			handleMessage(eventChan, line, parseMessage)
+		})
+		finished <- true
+	}()
+	client.Write([]byte("test.foo:1|c\n"))
+	if event := <-eventChan; event.Name != "test.foo" {
+		t.Errorf("Expected event %q, got %q", "test.foo", event.Name)
+	}
+	if !tracker.startHandler() {
+		t.Fatalf("Expected handlers to start before shutting down")
+	}
+	closed := make(chan bool)
+	go func() {
+		tracker.closeAndWait()
+		closed <- true
+	}()
+	// The connection is closed, but the running handler is waited for
+	<-finished
+	select {
+	case <-closed:
+		t.Errorf("Expected shutdown to wait for the running HTTP handler")
+	case <-time.After(1e8):
+	}
+	tracker.handlerDone()
+	<-closed
+	if tracker.startHandler() || tracker.add(client) != nil {
+		t.Errorf("Expected new handlers and connections to be rejected while shutting down")
+	}
+}
+
+// Load a config from a temporary file
+func loadTestConfig(data string, commandLine map[string]bool) os.Error {
+	file, err := ioutil.TempFile("", "appchilada-config")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(data)
+	file.Close()
+	return loadConfig(file.Name(), commandLine)
+}
+
+func TestLoadConfig(t *testing.T) {
+	// An empty config resets the flags to their defaults
+	defer loadTestConfig("{}", nil)
+	flag.Set("interval", "20")
+	err := loadTestConfig(`{
+		"interval": 5,
+		"retention": 7,
+		"listeners": {"tcp": {"port": 9000}, "graphite": {"port": 2003, "counts": "^stats\\."}},
+		"backends": [
+			{"host": "a", "port": 5984, "database": "x"},
+			{"host": "b", "port": 5985, "database": "y"}
+		],
+		"frontend": {"development": false}
+	}`, map[string]bool{"interval": true})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if *interval != 20 {
+		t.Errorf("Expected interval %d from the command line, got %d", 20, *interval)
+	}
+	if *retention != 7 || *tcpPort != 9000 || *graphitePort != 2003 || *graphiteCounts != "^stats\\." {
+		t.Errorf("Expected values from the config, got retention %d, tcp port %d, graphite port %d and counts %q",
+			*retention, *tcpPort, *graphitePort, *graphiteCounts)
+	}
+	if *couchDbs != "a:5984/x,b:5985/y" {
+		t.Errorf("Expected backends %q, got %q", "a:5984/x,b:5985/y", *couchDbs)
+	}
+	if *development {
+		t.Errorf("Expected development to be disabled")
+	}
+	if err := loadTestConfig("{}", nil); err != nil || flag.Lookup("tcp-port").Value.String() != flag.Lookup("tcp-port").DefValue {
+		t.Errorf("Expected flags missing from the config to be reset, got tcp port %d (%v)", *tcpPort, err)
+	}
+}
+
+func TestLoadConfigBackendWithoutPort(t *testing.T) {
+	defer loadTestConfig("{}", nil)
+	if err := loadTestConfig(`{"backends": [{"host": "a", "database": "x"}]}`, nil); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if errs := validateFlags(); len(errs) != 1 || !strings.Contains(fmt.Sprint(errs), "port must be between 1 and 65535") {
+		t.Errorf("Expected an error for the missing port, got %v", errs)
+	}
+}
+
+var invalidConfigTests = []struct {
+	config string
+	error  string
+}{
+	{`{"intervall": 5}`, `unknown key "intervall"`},
+	{`{"listeners": {"tcp": {"prot": 9000}}}`, `unknown key "listeners.tcp.prot"`},
+	{`{"listeners": {"udp": {"port": 8125, "counts": "x"}}}`, `unknown key "listeners.udp.counts"`},
+	{`{"backends": [{"host": "a"}, {"host": "b", "prot": 5984}]}`, `unknown key "backends.prot"`},
+	{`{"frontend": {"adress": ":80"}}`, `unknown key "frontend.adress"`},
+	{`{"interval": "5"}`, "invalid value"},
+	{`{"listeners": {"tcp": {"port": 9000}`, "invalid JSON"},
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	defer loadTestConfig("{}", nil)
+	for _, test := range invalidConfigTests {
+		err := loadTestConfig(test.config, nil)
+		if err == nil || !strings.Contains(err.String(), test.error) {
+			t.Errorf("Expected error %q for %s, got %v", test.error, test.config, err)
+		}
+	}
+}
+
+func TestValidateFlags(t *testing.T) {
+	defer loadTestConfig("{}", nil)
+	if errs := validateFlags(); len(errs) > 0 {
+		t.Errorf("Expected the defaults to be valid, got %v", errs)
+	}
+	flag.Set("tcp-port", "70000")
+	flag.Set("port", "0")
+	flag.Set("interval", "0")
+	flag.Set("influx-port", "-1")
+	flag.Set("graphite-port", "65536")
+	flag.Set("couchdb", "127.0.0.1:5984/x, :5984/x, 127.0.0.1:0/x,127.0.0.1/x")
+	expected := []string{
+		`-couchdb: Invalid CouchDB backend ":5984/x", must be host:port/database`,
+		`-couchdb: Invalid CouchDB backend "127.0.0.1:0/x", port must be between 1 and 65535`,
+		`-couchdb: Invalid CouchDB backend "127.0.0.1/x", must be host:port/database`,
+		"-graphite-port: port 65536 out of range",
+		"-influx-port: port -1 out of range",
+		"-interval: must be at least 1 second, got 0",
+		"-port: port 0 out of range",
+		"-tcp-port: port 70000 out of range",
+	}
+	// The errors are sorted by flag name on every run
+	for i := 0; i < 5; i++ {
+		errs := validateFlags()
+		messages := make([]string, len(errs))
+		for j, err := range errs {
+			messages[j] = err.String()
+		}
+		if strings.Join(messages, "\n") != strings.Join(expected, "\n") {
+			t.Fatalf("Expected errors %q, got %q", expected, messages)
+		}
+	}
+}
+
+// Format an event with its tags in a stable order, fields with their zero value are left out
+func formatEvent(e *appchilada.Event) string {
+	s := fmt.Sprintf("%d %s %d", e.Type, appchilada.SeriesKey(e.Name, e.Tags), e.Value)
+	if e.Delta {
+		s += " delta"
+	}
+	if e.Member != "" {
+		s += " member=" + e.Member
+	}
+	if e.SampleRate != 0 {
+		s += fmt.Sprintf(" @%g", e.SampleRate)
+	}
+	if e.Time != 0 {
+		s += fmt.Sprintf(" time=%d", e.Time)
+	}
+	return s
+}
+
+type messageTest struct {
+	message string
+	// Formatted events
+	events []string
+	errors int
+}
+
+func testMessageParser(t *testing.T, parse parser, tests []messageTest) {
+	for _, test := range tests {
+		events, errs := parse([]byte(test.message))
+		formatted := make([]string, len(events))
+		for i, event := range events {
+			formatted[i] = formatEvent(event)
+		}
+		if strings.Join(formatted, ", ") != strings.Join(test.events, ", ") {
+			t.Errorf("Expected events %q for %q, got %q", test.events, test.message, formatted)
+		}
+		if len(errs) != test.errors {
+			t.Errorf("Expected %d errors for %q, got %v", test.errors, test.message, errs)
+		}
+	}
+}
+
+var statsdTests = []messageTest{
+	{"test.foo:2|c", []string{"0 test.foo 2"}, 0},
+	{"test.foo:2|c|@0.5", []string{"0 test.foo 2 @0.5"}, 0},
+	{"test.foo:2.6|ms", []string{"1 test.foo 3"}, 0},
+	{"test.foo:10|g", []string{"2 test.foo 10"}, 0},
+	{"test.foo:+3|g", []string{"2 test.foo 3 delta"}, 0},
+	{"test.foo:-3|g", []string{"2 test.foo -3 delta"}, 0},
+	{"test.foo:-3|c", []string{"0 test.foo -3"}, 0},
+	{"test.foo:bar|s", []string{"3 test.foo 0 member=bar"}, 0},
+	{"test.foo:1|c|#host:a,region:eu", []string{"0 test.foo;host=a;region=eu 1"}, 0},
+	{"test.foo:1|ms|@0.1|#canary", []string{"1 test.foo;canary= 1 @0.1"}, 0},
+	{"test.foo:1|c\n\ntest.bar:2|g\n", []string{"0 test.foo 1", "2 test.bar 2"}, 0},
+	{"test.foo:1|c\ntest.foo\ntest.bar:2|g", []string{"0 test.foo 1", "2 test.bar 2"}, 1},
+	{"test.foo", nil, 1},
+	{":1|c", nil, 1},
+	{"test.foo:1", nil, 1},
+	{"test.foo:1|x", nil, 1},
+	{"test.foo:x|c", nil, 1},
+	{"test.foo:|g", nil, 1},
+	{"test.foo:1|c|@0", nil, 1},
+	{"test.foo:1|c|@2", nil, 1},
+	{"test.foo:1|c|@x", nil, 1},
+}
+
+func TestParseStatsdMessage(t *testing.T) {
+	testMessageParser(t, parseStatsdMessage, statsdTests)
+}
+
+var jsonTests = []messageTest{
+	{`{"Type": 0, "Name": "test.foo", "Value": 2}`, []string{"0 test.foo 2"}, 0},
+	{`{"Type": 2, "Name": "test.foo", "Value": -1, "Delta": true, "Time": 1323017545}`, []string{"2 test.foo -1 delta time=1323017545"}, 0},
+	{`{"Type": 3, "Name": "test.foo", "Member": "bar", "Tags": {"host": "a"}}`, []string{"3 test.foo;host=a 0 member=bar"}, 0},
+	// A single event spanning multiple lines
+	{"{\n\t\"Name\": \"test.foo\",\n\t\"Value\": 2\n}", []string{"0 test.foo 2"}, 0},
+	{`[{"Name": "test.foo", "Value": 1}, {"Name": "test.bar", "Value": 2, "SampleRate": 0.5}]`, []string{"0 test.foo 1", "0 test.bar 2 @0.5"}, 0},
+	{`[{"Name": "test.foo", "Value": "x"}, {"Name": "test.bar", "Value": 2}]`, []string{"0 test.bar 2"}, 1},
+	{`[{"Name": "test.foo"`, nil, 1},
+	// Newline delimited events
+	{"{\"Name\": \"test.foo\", \"Value\": 1}\n\n{\"Name\": \"test.bar\", \"Value\": 2}\n", []string{"0 test.foo 1", "0 test.bar 2"}, 0},
+	{"{\"Name\": \"test.foo\", \"Value\": 1}\nnot json\n{\"Name\": \"test.bar\", \"Value\": 2}", []string{"0 test.foo 1", "0 test.bar 2"}, 1},
+	{"not json", nil, 1},
+}
+
+func TestParseJsonMessage(t *testing.T) {
+	testMessageParser(t, parseJsonMessage, jsonTests)
+}
+
+var influxTests = []messageTest{
+	{"cpu,host=a usage=1.5,idle=98i 1465839830100400200", []string{"2 cpu.usage;host=a 2 time=1465839830", "2 cpu.idle;host=a 98 time=1465839830"}, 0},
+	{"cpu ok=true,failed=F,count=5u", []string{"2 cpu.ok 1", "2 cpu.failed 0", "2 cpu.count 5"}, 0},
+	// String fields are skipped, separators in them are not split
+	{`cpu message="a b,c=d",value=1`, []string{"2 cpu.value 1"}, 0},
+	{`my\ cpu,host=a\,b,region=eu value=-2.5`, []string{"2 my cpu.value;host=a,b;region=eu -2"}, 0},
+	{"# comment\n\ncpu value=1\nmem free=2\n", []string{"2 cpu.value 1", "2 mem.free 2"}, 0},
+	{"cpu value=1\ncpu\nmem free=2", []string{"2 cpu.value 1", "2 mem.free 2"}, 1},
+	{",host=a value=1", nil, 1},
+	{"cpu,host value=1", nil, 1},
+	{"cpu value=", nil, 1},
+	{"cpu value", nil, 1},
+	{"cpu value=x", nil, 1},
+	{"cpu value=1 x", nil, 1},
+	{"cpu value=1 1 1", nil, 1},
+}
+
+func TestParseInfluxMessage(t *testing.T) {
+	testMessageParser(t, parseInfluxMessage, influxTests)
+}
+
+var influxPrecisionTests = []struct {
+	precision string
+	timestamp string
+}{
+	{"", "1465839830100400200"},
+	{"n", "1465839830100400200"},
+	{"u", "1465839830100400"},
+	{"ms", "1465839830100"},
+	{"s", "1465839830"},
+	{"m", "24430663"},
+	{"h", "407177"},
+}
+
+func TestInfluxWritePrecision(t *testing.T) {
+	eventChan := make(chan appchilada.Event, 1)
+	handler := influxWriteHandler(eventChan)
+	expected := map[string]int64{"m": 1465839780, "h": 1465837200}
+	for _, test := range influxPrecisionTests {
+		request, _ := http.NewRequest("POST", "/write?db=test&precision="+test.precision, strings.NewReader("cpu value=1 "+test.timestamp))
+		response := httptest.NewRecorder()
+		handler(response, request)
+		if response.Code != http.StatusNoContent {
+			t.Errorf("Expected status %d for precision %q, got %d", http.StatusNoContent, test.precision, response.Code)
+			continue
+		}
+		seconds, ok := expected[test.precision]
+		if !ok {
+			seconds = 1465839830
+		}
+		if event := <-eventChan; event.Time != seconds {
+			t.Errorf("Expected time %d for precision %q, got %d", seconds, test.precision, event.Time)
+		}
+	}
+	request, _ := http.NewRequest("POST", "/write?precision=d", strings.NewReader("cpu value=1 1"))
+	response := httptest.NewRecorder()
+	handler(response, request)
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an invalid precision, got %d", http.StatusBadRequest, response.Code)
+	}
+}
+
+var graphiteTests = []struct {
+	line string
+	// Formatted point or empty if the line is invalid
+	point string
+}{
+	{"servers.a.load 1.6 1323017545", "1323017545 2 servers.a.load 2"},
+	{"servers.a.load -1.6 1323017545.9", "1323017545 2 servers.a.load -2"},
+	{"stats.requests 10 1323017545", "1323017545 0 stats.requests 10"},
+	{"  servers.a.load\t1   1323017545 ", "1323017545 2 servers.a.load 1"},
+	{"servers.a.load 1", ""},
+	{"servers.a.load x 1323017545", ""},
+	{"servers.a.load 1 x", ""},
+	{"servers.a.load 1 1323017545 1", ""},
+}
+
+func TestParseGraphiteLine(t *testing.T) {
+	countPattern := regexp.MustCompile(`^stats\.`)
+	for _, test := range graphiteTests {
+		p, err := parseGraphiteLine([]byte(test.line), countPattern)
+		if test.point == "" {
+			if err == nil {
+				t.Errorf("Expected an error for %q, got point %d %s", test.line, p.timestamp, formatEvent(p.event))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error %v for %q", err, test.line)
+		} else if formatted := fmt.Sprintf("%d %s", p.timestamp, formatEvent(p.event)); formatted != test.point {
+			t.Errorf("Expected point %q for %q, got %q", test.point, test.line, formatted)
+		}
+	}
+	// Graphite clients send -1 for the current time
+	now := time.Seconds()
+	if p, err := parseGraphiteLine([]byte("servers.a.load 1 -1"), nil); err != nil || p.timestamp < now || p.timestamp > now+1 {
+		t.Errorf("Expected the current time for timestamp -1, got %v (%v)", p, err)
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	longest := strings.Repeat("x", maxLineLength-1) + "\n"
+	reader := bufio.NewReader(strings.NewReader("a\n" + longest + "x" + longest + "b\nc"))
+	expected := []struct {
+		line string
+		err  os.Error
+	}{
+		{"a\n", nil},
+		{longest, nil},
+		{"", errLineTooLong},
+		{"b\n", nil},
+		{"c", os.EOF},
+	}
+	for _, e := range expected {
+		line, err := readLine(reader)
+		if string(line) != e.line || err != e.err {
+			t.Errorf("Expected line of %d bytes (%v), got %d bytes (%v)", len(e.line), e.err, len(line), err)
+		}
+	}
+}
+
+func TestEventsHandlerRequestSize(t *testing.T) {
+	handler := eventsHandler(make(chan appchilada.Event))
+	expected := map[int]int{maxRequestSize: http.StatusAccepted, maxRequestSize + 1: http.StatusRequestEntityTooLarge}
+	for size, status := range expected {
+		request, _ := http.NewRequest("POST", "/events", strings.NewReader(strings.Repeat(" ", size)))
+		response := httptest.NewRecorder()
+		handler(response, request)
+		if response.Code != status {
+			t.Errorf("Expected status %d for a body of %d bytes, got %d", status, size, response.Code)
+		}
+	}
+}
+
+func TestSpoolPath(t *testing.T) {
+	couchDb, _ := parseCouchDb("db.example.com:5984/stats/eu")
+	if path := spoolPath("/var/spool/appchilada", couchDb); path != "/var/spool/appchilada.db.example.com_5984_stats_eu" {
+		t.Errorf("Expected spool path %q, got %q", "/var/spool/appchilada.db.example.com_5984_stats_eu", path)
+	}
+}
+
+func TestEventLoopLargeDatagram(t *testing.T) {
+	socket, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners["test-udp"] = socket
+	defer stopListener("test-udp")
+	eventChan := make(chan appchilada.Event, 1000)
+	go eventLoop(eventChan, socket, parseMessage)
+
+	// A JSON array larger than a page is received as a whole
+	items := make([]string, 500)
+	for i := range items {
+		items[i] = fmt.Sprintf(`{"Name": "test.foo", "Value": %d}`, i)
+	}
+	message := "[" + strings.Join(items, ",") + "]"
+	client, err := net.DialUDP("udp4", nil, socket.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	for i := range items {
+		select {
+		case event := <-eventChan:
+			if event.Value != int64(i) {
+				t.Fatalf("Expected event %d of the %d byte datagram, got %d", i, len(message), event.Value)
+			}
+		case <-time.After(1e9):
+			t.Fatalf("Expected %d events of the %d byte datagram, got %d", len(items), len(message), i)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"time"
+	"appchilada"
+)
+
+// Wait for SIGINT, SIGTERM or SIGHUP and return the signal
+func waitForSignal() os.UnixSignal {
+	for sig := range signal.Incoming {
+		if unixSig, ok := sig.(os.UnixSignal); ok && (unixSig == os.SIGINT || unixSig == os.SIGTERM || unixSig == os.SIGHUP) {
+			log.Printf("Received %v", sig)
+			return unixSig
+		}
+	}
+	panic("unreachable")
+}
+
+// Close the listeners and open connections, wait for the running handlers, let the writers
+// store their remaining events and close the backend
+// Exits with an error if this takes longer than timeout seconds
+func shutdown(writers []chan chan bool, backend appchilada.Backend, timeout int) {
+	done := make(chan bool)
+	go func() {
+		for _, name := range listenerNames {
+			stopListener(name)
+		}
+		// Handlers block until the writers received their events
+		connections.closeAndWait()
+		for _, quit := range writers {
+			stored := make(chan bool)
+			quit <- stored
+			<-stored
+		}
+		if err := backend.Close(); err != nil {
+			log.Printf("Error closing backend: %v", err)
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+		log.Printf("Shutdown complete")
+	case <-time.After(int64(timeout) * 1e9):
+		log.Fatalf("Shutdown did not complete within %d seconds", timeout)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+// Snappy element types in the low bits of a tag byte
+const (
+	snappyLiteral = 0
+	snappyCopy1   = 1
+	snappyCopy2   = 2
+	snappyCopy4   = 3
+)
+
+var errSnappyCorrupt = os.NewError("snappy data corrupt")
+
+// Decode a snappy block (without the framing format), as used by Prometheus remote_write
+// The decoded size is limited to maxRequestSize
+func snappyDecode(src []byte) ([]byte, os.Error) {
+	r := newProtoReader(src)
+	length, err := r.varint()
+	if err != nil {
+		return nil, errSnappyCorrupt
+	}
+	if length > maxRequestSize {
+		return nil, errRequestTooLarge
+	}
+	dst := make([]byte, 0, length)
+	for s := r.pos; s < len(src); {
+		tag := src[s]
+		s++
+		var n, offset int
+		switch tag & 3 {
+		case snappyLiteral:
+			n = int(tag >> 2)
+			if n >= 60 {
+				// The length minus one follows in 1 to 4 bytes
+				size := n - 59
+				if s+size > len(src) {
+					return nil, errSnappyCorrupt
+				}
+				n = 0
+				for i := size - 1; i >= 0; i-- {
+					n = n<<8 | int(src[s+i])
+				}
+				s += size
+			}
+			n++
+			if n <= 0 || s+n > len(src) || len(dst)+n > int(length) {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[s:s+n]...)
+			s += n
+			continue
+		case snappyCopy1:
+			if s+1 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			n = 4 + int(tag>>2&7)
+			offset = int(tag&0xe0)<<3 | int(src[s])
+			s++
+		case snappyCopy2:
+			if s+2 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			n = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s:]))
+			s += 2
+		case snappyCopy4:
+			if s+4 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			n = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s:]))
+			s += 4
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+n > int(length) {
+			return nil, errSnappyCorrupt
+		}
+		// Copies may overlap the bytes they produce
+		start := len(dst) - offset
+		for i := 0; i < n; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+	if len(dst) != int(length) {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"appchilada"
+)
+
+// Map of StatsD metric types to event types
+var statsdTypes = map[string]int8{
+	"c":  appchilada.EventTypeCount,
+	"ms": appchilada.EventTypeTiming,
+	"g":  appchilada.EventTypeGauge,
+	"s":  appchilada.EventTypeSet,
+}
+
+// Check if a message looks like a JSON message (instead of StatsD lines)
+func isJsonMessage(message []byte) bool {
+	message = bytes.TrimSpace(message)
+	return len(message) > 0 && (message[0] == '{' || message[0] == '[')
+}
+
+// Parse a StatsD message with one or more newline separated metrics
+// Lines that could not be parsed are skipped and returned as errors
+func parseStatsdMessage(message []byte) (events []*appchilada.Event, errs []os.Error) {
+	for _, line := range bytes.Split(message, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if event, err := parseStatsdLine(line); err != nil {
+			errs = append(errs, err)
+		} else {
+			events = append(events, event)
+		}
+	}
+	return
+}
+
+// Parse a single StatsD line of the form <name>:<value>|<type>[|@<sample rate>][|#<tag>:<value>,...]
+func parseStatsdLine(line []byte) (*appchilada.Event, os.Error) {
+	colon := bytes.IndexByte(line, ':')
+	if colon < 1 {
+		return nil, fmt.Errorf("invalid StatsD line %q: missing name", line)
+	}
+	fields := bytes.Split(line[colon+1:], []byte("|"))
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid StatsD line %q: missing type", line)
+	}
+	eventType, ok := statsdTypes[string(fields[1])]
+	if !ok {
+		return nil, fmt.Errorf("invalid StatsD line %q: unsupported type %s", line, fields[1])
+	}
+	event := &appchilada.Event{
+		Type: eventType,
+		Name: string(line[:colon]),
+	}
+	for _, field := range fields[2:] {
+		if len(field) > 0 && field[0] == '@' {
+			rate, err := strconv.Atof64(string(field[1:]))
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, fmt.Errorf("invalid StatsD line %q: invalid sample rate %s", line, field[1:])
+			}
+			event.SampleRate = rate
+		}
+		if len(field) > 0 && field[0] == '#' {
+			event.Tags = parseStatsdTags(field[1:])
+		}
+	}
+	if eventType == appchilada.EventTypeSet {
+		event.Member = string(fields[0])
+		return event, nil
+	}
+	value, err := strconv.Atof64(string(fields[0]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid StatsD line %q: %v", line, err)
+	}
+	event.Value = int64(math.Floor(value + 0.5))
+	// A signed gauge value changes the last value instead of replacing it
+	event.Delta = eventType == appchilada.EventTypeGauge && (fields[0][0] == '+' || fields[0][0] == '-')
+	return event, nil
+}
+
+// Parse DogStatsD tags of the form key:value,key2:value2, tags without a value get an empty value
+func parseStatsdTags(field []byte) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range bytes.Split(field, []byte(",")) {
+		if len(tag) == 0 {
+			continue
+		}
+		if i := bytes.IndexByte(tag, ':'); i >= 0 {
+			tags[string(tag[:i])] = string(tag[i+1:])
+		} else {
+			tags[string(tag)] = ""
+		}
+	}
+	return tags
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"appchilada"
+)
+
+func initializeTcpListener(address string, port int) (*net.TCPListener, os.Error) {
+	ip := net.ParseIP(address)
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{
+		IP:   ip,
+		Port: port,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error opening TCP listener: %v", err)
+	}
+	log.Printf("Starting appchilada server on tcp://%s:%d", ip.String(), port)
+	return listener, nil
+}
+
+// Maximum length of a line on a stream connection, longer lines are skipped
+const maxLineLength = 64 * 1024
+
+var errLineTooLong = os.NewError("line too long")
+
+// Accept TCP or Unix stream connections with newline delimited JSON events or StatsD lines
+func acceptLoop(eventChan chan appchilada.Event, listener net.Listener) {
+	acceptLines(listener, "Event", func(line []byte) {
+		handleMessage(eventChan, line, parseMessage)
+	})
+}
+
+// Accept stream connections and read each connection in its own goroutine
+// The connection name is used in log messages
+func acceptLines(listener net.Listener, name string, handle func(line []byte)) {
+	defer forgetListener(listener)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if isClosed(listener) {
+				return
+			}
+			log.Printf("%s accept error: %v", name, err)
+			continue
+		}
+		if e := connections.add(conn); e != nil {
+			go func() {
+				defer connections.remove(e)
+				readLines(conn, name, handle)
+			}()
+		}
+	}
+}
+
+// Call handle with every line until the connection is closed
+func readLines(conn net.Conn, name string, handle func(line []byte)) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := readLine(reader)
+		if err == errLineTooLong {
+			log.Printf("%s line longer than %d bytes from %v skipped", name, maxLineLength, conn.RemoteAddr())
+			continue
+		}
+		if len(line) > 0 {
+			handle(line)
+		}
+		if err != nil {
+			if err != os.EOF {
+				log.Printf("%s read error from %v: %v", name, conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+// Read a line of at most maxLineLength bytes, a longer line is discarded up to its end
+// and errLineTooLong is returned
+func readLine(reader *bufio.Reader) ([]byte, os.Error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLong && len(line)+len(chunk) > maxLineLength {
+			tooLong = true
+			line = nil
+		}
+		if !tooLong {
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if tooLong && err == nil {
+			return nil, errLineTooLong
+		}
+		return line, err
+	}
+	panic("unreachable")
+}
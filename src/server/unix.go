@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+)
+
+// Open a Unix stream socket at path with the given file permissions
+func initializeUnixListener(path string, mode uint32) (*net.UnixListener, os.Error) {
+	addr, err := net.ResolveUnixAddr("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("Error resolving Unix socket %s: %v", path, err)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening Unix socket: %v", err)
+	}
+	if err := chmodSocket(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	log.Printf("Starting appchilada server on unix://%s", path)
+	return listener, nil
+}
+
+// Open a Unix datagram socket at path with the given file permissions
+func initializeUnixgramSocket(path string, mode uint32) (*net.UnixConn, os.Error) {
+	addr, err := net.ResolveUnixAddr("unixgram", path)
+	if err != nil {
+		return nil, fmt.Errorf("Error resolving Unix datagram socket %s: %v", path, err)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	socket, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening Unix datagram socket: %v", err)
+	}
+	if err := chmodSocket(path, mode); err != nil {
+		socket.Close()
+		return nil, err
+	}
+	log.Printf("Starting appchilada server on unixgram://%s", path)
+	return socket, nil
+}
+
+// Remove a socket file left by a previous run, other files are not touched
+func removeStaleSocket(path string) os.Error {
+	if info, err := os.Lstat(path); err == nil && info.IsSocket() {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("Error removing stale socket %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+func chmodSocket(path string, mode uint32) os.Error {
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("Error changing permissions of socket %s: %v", path, err)
+	}
+	return nil
+}